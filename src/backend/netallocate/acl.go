@@ -0,0 +1,78 @@
+package netallocate
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"strings"
+	"util/log"
+)
+
+// 地址池通过namespaces和namespaceSelector限制可以从中分配IP的namespace
+// 两者都未配置时不限制, 否则namespace在列表中或标签匹配selector其中之一即可
+
+// namespace无权使用地址池时返回
+type NamespaceDeniedError struct {
+	IpGroup   string
+	Namespace string
+	// 地址池允许的namespace以及selector, 用于提示
+	Allowed  []string
+	Selector string
+}
+
+func (e *NamespaceDeniedError) Error() string {
+	msg := fmt.Sprintf("Namespace: %s Is Not Allowed To Allocate From Pool: %s", e.Namespace, e.IpGroup)
+	if len(e.Allowed) > 0 {
+		msg += ", Allowed Namespaces: " + strings.Join(e.Allowed, ",")
+	}
+	if e.Selector != "" {
+		msg += ", Namespace Selector: " + e.Selector
+	}
+	return msg
+}
+
+func (p *Pool) restrictsNamespace() bool {
+	return len(p.Namespaces) > 0 || p.nsSelector != nil
+}
+
+// nsLabels只在地址池配置了namespaceSelector并且namespace不在列表中时调用
+func (p *Pool) allowsNamespace(namespace string, nsLabels func() (map[string]string, error)) (bool, error) {
+	if !p.restrictsNamespace() {
+		return true, nil
+	}
+	for _, val := range p.Namespaces {
+		if val == namespace {
+			return true, nil
+		}
+	}
+	if p.nsSelector == nil {
+		return false, nil
+	}
+	labelSet, err := nsLabels()
+	if err != nil {
+		return false, err
+	}
+	return p.nsSelector.Matches(labels.Set(labelSet)), nil
+}
+
+// ADD分配前校验namespace能否使用地址池, 无权使用时返回*NamespaceDeniedError
+func CheckNamespaceAccess(ctx context.Context, ipGroup, namespace string, nsLabels func() (map[string]string, error)) error {
+	pool, err := GetPool(ctx, ipGroup)
+	if err != nil {
+		return err
+	}
+	allowed, err := pool.allowsNamespace(namespace, nsLabels)
+	if err != nil {
+		return err
+	}
+	if allowed {
+		return nil
+	}
+	denied := &NamespaceDeniedError{IpGroup: ipGroup, Namespace: namespace, Allowed: pool.Namespaces}
+	if pool.NamespaceSelector != nil {
+		denied.Selector = metav1.FormatLabelSelector(pool.NamespaceSelector)
+	}
+	log.Errorf("namespace: %s 无权使用地址池: %s", namespace, ipGroup)
+	return denied
+}
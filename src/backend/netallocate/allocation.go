@@ -0,0 +1,131 @@
+package netallocate
+
+import (
+	"context"
+	"sort"
+	"time"
+	"util/log"
+)
+
+// IP分配记录, etcd后端存放在<prefix>/groups/<ipgroup>/allocations/<ip>, CRD后端为IPAllocation对象
+// 归还后保留记录并填写ReleasedAt, 直到该IP被再次分配, 用于审计以及根据IP反查Pod
+// 归还或被覆盖前写入历史记录, etcd后端为<prefix>/groups/<ipgroup>/history/<ip>/<分配时间>, CRD后端为IPAllocation的spec.history
+type Allocation struct {
+	Ip           string     `json:"ip"`
+	ContainerId  string     `json:"containerId"`
+	IfName       string     `json:"ifName"`
+	PodNamespace string     `json:"podNamespace"`
+	PodName      string     `json:"podName"`
+	PodUid       string     `json:"podUid"`
+	NodeName     string     `json:"nodeName"`
+	VlanId       int        `json:"vlanId"`
+	HostIfName   string     `json:"hostIfName"`
+	AllocatedAt  time.Time  `json:"allocatedAt"`
+	ReleasedAt   *time.Time `json:"releasedAt,omitempty"`
+}
+
+// 每个IP保留的历史记录数量, 超出后删除最早的记录
+const maxAllocationHistory = 32
+
+// 覆盖其他容器未归还的记录前先写入历史, 已归还的记录在归还时已经写入
+func SaveAllocation(ctx context.Context, ipGroup string, a *Allocation) error {
+	prev, err := overwrittenAllocation(ctx, ipGroup, a)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		if err := backend.SaveHistory(ctx, ipGroup, prev); err != nil {
+			return err
+		}
+	}
+	return backend.SaveAllocation(ctx, ipGroup, a)
+}
+
+// 返回a将要覆盖的其他容器未归还的记录, 没有时返回nil
+func overwrittenAllocation(ctx context.Context, ipGroup string, a *Allocation) (*Allocation, error) {
+	prev, err := backend.GetAllocation(ctx, ipGroup, a.Ip)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prev.ReleasedAt != nil || prev.ContainerId == a.ContainerId {
+		return nil, nil
+	}
+	log.Warnf("IP: %s 的分配记录未归还就被容器: %s 覆盖, 原占用者: %s/%s", a.Ip, a.ContainerId, prev.PodNamespace, prev.PodName)
+	return prev, nil
+}
+
+// 未找到记录时返回ErrNotFound
+func GetAllocation(ctx context.Context, ipGroup, ip string) (*Allocation, error) {
+	return backend.GetAllocation(ctx, ipGroup, ip)
+}
+
+// 将分配记录标记为已归还, 返回该IP当前是否仍归containerId所有
+// IP已被其他容器重新占用时返回false, 调用方不能再归还该IP
+func ReleaseAllocation(ctx context.Context, ipGroup, ip, containerId string) (bool, error) {
+	a, err := GetAllocation(ctx, ipGroup, ip)
+	if err == ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if a.ContainerId != containerId {
+		log.Warnf("IP: %s 已被容器: %s 占用, 不再归还", ip, a.ContainerId)
+		return false, nil
+	}
+	if a.ReleasedAt != nil {
+		return true, nil
+	}
+	now := time.Now()
+	a.ReleasedAt = &now
+	// 先写历史记录, IP再次分配覆盖当前记录后仍能查到之前的占用者
+	if err := backend.SaveHistory(ctx, ipGroup, a); err != nil {
+		return false, err
+	}
+	if err := backend.SaveAllocation(ctx, ipGroup, a); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 返回IP的历史分配记录, 按分配时间升序
+func ListAllocationHistory(ctx context.Context, ipGroup, ip string) ([]*Allocation, error) {
+	history, err := backend.ListHistory(ctx, ipGroup, ip)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].AllocatedAt.Before(history[j].AllocatedAt)
+	})
+	return history, nil
+}
+
+// 返回at时刻占用IP的分配记录, 取分配时间不晚于at的最后一条, 当时IP空闲或超出保留范围时返回ErrNotFound
+func AllocationAt(ctx context.Context, ipGroup, ip string, at time.Time) (*Allocation, error) {
+	history, err := ListAllocationHistory(ctx, ipGroup, ip)
+	if err != nil {
+		return nil, err
+	}
+	current, err := GetAllocation(ctx, ipGroup, ip)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if current != nil {
+		history = append(history, current)
+	}
+
+	var holder *Allocation
+	for _, a := range history {
+		if a.AllocatedAt.After(at) {
+			break
+		}
+		holder = a
+	}
+	if holder == nil || (holder.ReleasedAt != nil && !at.Before(*holder.ReleasedAt)) {
+		return nil, ErrNotFound
+	}
+	return holder, nil
+}
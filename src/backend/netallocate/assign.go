@@ -0,0 +1,156 @@
+package netallocate
+
+import (
+	"context"
+	"time"
+	"util/log"
+)
+
+// ADD分配和DEL回收的完整流程, multi-vlan-cni、etcdipam以及GC共用, 保证各处的步骤和顺序一致
+
+// 登记撤销步骤, 调用方在后续步骤失败时逆序执行
+type UndoRecorder func(name string, undo func(ctx context.Context) error)
+
+type AssignRequest struct {
+	IpGroup      string
+	IpRange      []string
+	ContainerId  string
+	IfName       string
+	PodNamespace string
+	PodName      string
+	PodUid       string
+	NodeName     string
+	// Pod通过annotation开启固定IP, 地址池开启sticky时同样启用
+	StickyOptIn bool
+	// 取得IP之后、保存记录之前调用, 返回IP所属VLAN以及host侧接口, 写入分配记录和Attachment
+	// 只分配IP不配置接口时为nil
+	Setup func(ctx context.Context, ip, gateway string) (vlanId int, hostIfName string, err error)
+}
+
+// 开启固定IP时优先取回为同名Pod保留的IP, 否则从地址池分配, 随后保存分配记录和Attachment
+// 每完成一步通过undo登记撤销步骤, 返回的Attachment即本次分配结果
+// ipRange中没有空闲IP时返回ErrNoMatchedIp
+func Assign(ctx context.Context, req *AssignRequest, undo UndoRecorder) (*Attachment, error) {
+	ipGroup := req.IpGroup
+	// 固定IP按Pod名称保留, 非kubelet调用时没有Pod名称, 不开启
+	sticky := false
+	if req.PodName != "" {
+		var err error
+		if sticky, err = StickyEnabled(ctx, ipGroup, req.StickyOptIn); err != nil {
+			log.Errorf("获取地址池: %s 固定IP配置失败, 错误信息: %s", ipGroup, err.Error())
+			return nil, err
+		}
+	}
+
+	// 分配记录先随位图写入, 配置接口后补充VLAN和host侧接口
+	allocation := &Allocation{
+		ContainerId:  req.ContainerId,
+		IfName:       req.IfName,
+		PodNamespace: req.PodNamespace,
+		PodName:      req.PodName,
+		PodUid:       req.PodUid,
+		NodeName:     req.NodeName,
+		AllocatedAt:  time.Now(),
+	}
+	var configIp, configGw string
+	var reservation *StickyReservation
+	var err error
+	if sticky {
+		reservation, configGw, err = ClaimSticky(ctx, ipGroup, req.PodNamespace, req.PodName, req.IpRange)
+		if err != nil {
+			log.Errorf("取回Pod: %s/%s 的保留IP失败, 错误信息: %s", req.PodNamespace, req.PodName, err.Error())
+			return nil, err
+		}
+	}
+	if reservation != nil {
+		configIp = reservation.Ip
+		undo("恢复保留IP: "+configIp, func(ctx context.Context) error {
+			return UnclaimSticky(ctx, ipGroup, reservation)
+		})
+	} else {
+		configIp, configGw, err = IpAllocate(ctx, ipGroup, req.IpRange, allocation)
+		if err != nil {
+			return nil, err
+		}
+		undo("归还IP: "+configIp, func(ctx context.Context) error {
+			return unassign(ctx, ipGroup, configIp, req.ContainerId, nil)
+		})
+	}
+	allocation.Ip = configIp
+	log.Infof("containerid: %s, 从地址池: %s 分配IP: %s, 网关: %s", req.ContainerId, ipGroup, configIp, configGw)
+
+	attachment := &Attachment{
+		ContainerId:  req.ContainerId,
+		IfName:       req.IfName,
+		IpGroup:      ipGroup,
+		Ip:           configIp,
+		Gateway:      configGw,
+		PodNamespace: req.PodNamespace,
+		PodName:      req.PodName,
+		Sticky:       sticky,
+	}
+	if req.Setup != nil {
+		if attachment.VlanId, attachment.HostIfName, err = req.Setup(ctx, configIp, configGw); err != nil {
+			return nil, err
+		}
+	}
+
+	// 记录IP的占用者, 用于审计以及根据IP反查Pod
+	allocation.VlanId = attachment.VlanId
+	allocation.HostIfName = attachment.HostIfName
+	if err = SaveAllocation(ctx, ipGroup, allocation); err != nil {
+		log.Errorf("保存IP: %s 分配记录失败, 错误信息: %s", configIp, err.Error())
+		return nil, err
+	}
+	if reservation != nil {
+		undo("标记分配记录已归还: "+configIp, func(ctx context.Context) error {
+			_, err := ReleaseAllocation(ctx, ipGroup, configIp, req.ContainerId)
+			return err
+		})
+	}
+
+	// 记录本次分配的资源, 供DEL回收以及重复ADD时返回相同结果
+	if err = SaveAttachment(ctx, attachment); err != nil {
+		log.Errorf("保存Attachment记录失败, 错误信息: %s", err.Error())
+		return nil, err
+	}
+	undo("删除Attachment记录: "+req.ContainerId, func(ctx context.Context) error {
+		return DelAttachment(ctx, req.ContainerId, req.IfName)
+	})
+	return attachment, nil
+}
+
+// 回收Attachment记录对应的IP并删除记录
+func Unassign(ctx context.Context, attachment *Attachment) error {
+	return unassign(ctx, attachment.IpGroup, attachment.Ip, attachment.ContainerId, attachment)
+}
+
+// 先归还IP再删除Attachment记录, 中途失败时重试依然能找到记录
+// IP已被其他容器重新占用时只清理本容器的记录, 开启固定IP时为同名Pod保留而不是归还
+// attachment为nil时只处理分配记录和地址池
+func unassign(ctx context.Context, ipGroup, ip, containerId string, attachment *Attachment) error {
+	owned, err := ReleaseAllocation(ctx, ipGroup, ip, containerId)
+	if err != nil {
+		log.Errorf("更新IP: %s 分配记录失败, 错误信息: %s", ip, err.Error())
+		return err
+	}
+	if owned && attachment != nil && attachment.Sticky {
+		if err = ReserveSticky(ctx, ipGroup, attachment.PodNamespace, attachment.PodName, ip); err != nil {
+			log.Errorf("保留IP: %s 失败, 错误信息: %s", ip, err.Error())
+			return err
+		}
+	} else if owned {
+		if err = IpRelease(ctx, ipGroup, ip); err != nil {
+			log.Errorf("归还IP: %s 失败, 错误信息: %s", ip, err.Error())
+			return err
+		}
+	}
+	if attachment == nil {
+		return nil
+	}
+	if err = DelAttachment(ctx, attachment.ContainerId, attachment.IfName); err != nil {
+		log.Errorf("删除Attachment记录失败, 错误信息: %s", err.Error())
+		return err
+	}
+	return nil
+}
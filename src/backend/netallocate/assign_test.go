@@ -0,0 +1,109 @@
+package netallocate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAssignUnassign(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst, Sticky: true},
+	})
+	ctx := context.Background()
+	req := &AssignRequest{IpGroup: "app", ContainerId: "c1", IfName: "eth0", PodNamespace: "default", PodName: "web-0"}
+	var undo []string
+	record := func(name string, _ func(ctx context.Context) error) { undo = append(undo, name) }
+
+	attachment, err := Assign(ctx, req, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Ip != "10.0.0.2/24" || attachment.Gateway != "10.0.0.1/24" || !attachment.Sticky {
+		t.Fatalf("unexpected attachment: %+v", attachment)
+	}
+	if len(undo) != 2 {
+		t.Fatalf("undo steps = %v, want allocate and attachment", undo)
+	}
+	if a, err := m.GetAllocation(ctx, "app", attachment.Ip); err != nil || a.ContainerId != "c1" || a.ReleasedAt != nil {
+		t.Fatalf("allocation = %+v, %v", a, err)
+	}
+
+	// 固定IP在DEL时保留, 位图保持占用, 同名Pod重建时取回
+	if err = Unassign(ctx, attachment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.GetAttachment(ctx, "c1", "eth0"); err != ErrNotFound {
+		t.Fatalf("attachment not deleted: %v", err)
+	}
+	if a, _ := m.GetAllocation(ctx, "app", attachment.Ip); a.ReleasedAt == nil {
+		t.Fatal("allocation not marked released")
+	}
+	if reservations, _ := m.ListSticky(ctx, "app"); len(reservations) != 1 {
+		t.Fatalf("reservations = %v, want 1", reservations)
+	}
+
+	req.ContainerId = "c2"
+	again, err := Assign(ctx, req, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Ip != attachment.Ip {
+		t.Fatalf("sticky ip = %s, want %s", again.Ip, attachment.Ip)
+	}
+
+	// 非固定IP的Pod归还到地址池
+	other := &AssignRequest{IpGroup: "app", ContainerId: "c3", IfName: "eth0"}
+	third, err := Assign(ctx, other, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Sticky {
+		t.Fatal("request without pod name must not be sticky")
+	}
+	if err = Unassign(ctx, third); err != nil {
+		t.Fatal(err)
+	}
+	ip, _, err := IpAllocate(ctx, "app", nil, nil)
+	if err != nil || ip != third.Ip {
+		t.Fatalf("got %s, %v, want the released %s", ip, err, third.Ip)
+	}
+}
+
+// Setup失败时已完成的步骤都已登记, 由调用方回滚
+func TestAssignSetupFailure(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst},
+	})
+	ctx := context.Background()
+	setupErr := errors.New("setup failed")
+	var undo []func(ctx context.Context) error
+	req := &AssignRequest{
+		IpGroup:     "app",
+		ContainerId: "c1",
+		IfName:      "eth0",
+		Setup: func(ctx context.Context, ip, gateway string) (int, string, error) {
+			return 0, "", setupErr
+		},
+	}
+	_, err := Assign(ctx, req, func(name string, f func(ctx context.Context) error) { undo = append(undo, f) })
+	if err != setupErr {
+		t.Fatalf("err = %v, want %v", err, setupErr)
+	}
+	if len(undo) != 1 {
+		t.Fatalf("undo steps = %d, want 1", len(undo))
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err = undo[i](ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 随位图写入的分配记录在回滚时标记为已归还
+	if a, err := m.GetAllocation(ctx, "app", "10.0.0.2/24"); err != nil || a.ContainerId != "c1" || a.ReleasedAt == nil {
+		t.Fatalf("allocation = %+v, %v, want released record of c1", a, err)
+	}
+	ip, _, err := IpAllocate(ctx, "app", nil, nil)
+	if err != nil || ip != "10.0.0.2/24" {
+		t.Fatalf("got %s, %v, want the rolled back 10.0.0.2/24", ip, err)
+	}
+}
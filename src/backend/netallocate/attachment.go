@@ -0,0 +1,32 @@
+package netallocate
+
+import "context"
+
+// 记录一次ADD分配出去的资源, DEL时据此回收
+// etcd后端存放在<prefix>/attachments/<containerid>/<ifname>, CRD后端存放在对应IP的IPAllocation对象中
+type Attachment struct {
+	ContainerId string `json:"containerId"`
+	IfName      string `json:"ifName"`
+	IpGroup     string `json:"ipGroup"`
+	Ip          string `json:"ip"`
+	Gateway     string `json:"gateway"`
+	VlanId      int    `json:"vlanId"`
+	HostIfName  string `json:"hostIfName"`
+	// 开启固定IP时DEL为同名Pod保留IP而不是归还
+	PodNamespace string `json:"podNamespace"`
+	PodName      string `json:"podName"`
+	Sticky       bool   `json:"sticky"`
+}
+
+func SaveAttachment(ctx context.Context, a *Attachment) error {
+	return backend.SaveAttachment(ctx, a)
+}
+
+// 未找到记录时返回ErrNotFound
+func GetAttachment(ctx context.Context, containerId, ifName string) (*Attachment, error) {
+	return backend.GetAttachment(ctx, containerId, ifName)
+}
+
+func DelAttachment(ctx context.Context, containerId, ifName string) error {
+	return backend.DelAttachment(ctx, containerId, ifName)
+}
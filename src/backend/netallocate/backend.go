@@ -0,0 +1,72 @@
+package netallocate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s.io/client-go/rest"
+)
+
+// 后端类型, 在网络配置的backend字段中指定
+const (
+	BackendEtcd = "etcd"
+	BackendCRD  = "crd"
+)
+
+// 记录不存在时返回, 调用方据此区分"没有数据"和"访问失败"
+var ErrNotFound = errors.New("Record Not Found")
+
+// 地址池状态的存储后端
+// version为乐观锁版本号, etcd为ModRevision, CRD为resourceVersion
+// 所有方法在ctx结束后返回, 当前client-go不支持ctx, CRD后端只在每次请求前检查ctx
+type Backend interface {
+	// 返回未经Parse的地址池定义
+	GetPool(ctx context.Context, ipGroup string) (*Pool, error)
+	// 返回所有已定义的ipgroup
+	ListGroups(ctx context.Context) ([]string, error)
+	// 位图不存在时返回空字符串以及可用于首次写入的version
+	GetBitmap(ctx context.Context, ipGroup string) (data string, version string, err error)
+	// version与当前版本不一致时返回false
+	// claim不为nil时同时写入该IP的分配记录, 请求超时等结果不确定时据此判断位图是否已写入
+	SwapBitmap(ctx context.Context, ipGroup, data, version string, claim *Allocation) (bool, error)
+	// 返回子网到VLAN的映射, 格式为{"10.10.0.0/23": 2135}
+	GetVlanMap(ctx context.Context) (map[string]int, error)
+
+	SaveAllocation(ctx context.Context, ipGroup string, a *Allocation) error
+	GetAllocation(ctx context.Context, ipGroup, ip string) (*Allocation, error)
+	// 返回地址池下所有的分配记录, 包括已归还的
+	ListAllocations(ctx context.Context, ipGroup string) ([]*Allocation, error)
+	// 以IP和分配时间为键追加历史记录, 重复写入同一条记录时覆盖, 每个IP最多保留maxAllocationHistory条
+	SaveHistory(ctx context.Context, ipGroup string, a *Allocation) error
+	ListHistory(ctx context.Context, ipGroup, ip string) ([]*Allocation, error)
+
+	SaveSticky(ctx context.Context, ipGroup string, r *StickyReservation) error
+	ListSticky(ctx context.Context, ipGroup string) ([]*StickyReservation, error)
+	// 原子地取出并删除保留记录, 没有记录或被并发取走时返回nil
+	TakeSticky(ctx context.Context, ipGroup, podNamespace, podName string) (*StickyReservation, error)
+
+	SaveAttachment(ctx context.Context, a *Attachment) error
+	GetAttachment(ctx context.Context, containerId, ifName string) (*Attachment, error)
+	DelAttachment(ctx context.Context, containerId, ifName string) error
+}
+
+var backend Backend = &etcdBackend{prefix: DefaultEtcdPrefix}
+
+// 使用etcd后端, 调用前需要初始化etcdclient
+func UseEtcd(prefix string) error {
+	if err := ValidateEtcdPrefix(prefix); err != nil {
+		return err
+	}
+	backend = &etcdBackend{prefix: prefix}
+	return nil
+}
+
+// 使用CRD后端, 状态存放在IPPool和IPAllocation对象中
+func UseCRD(config *rest.Config) error {
+	b, err := newCrdBackend(config)
+	if err != nil {
+		return fmt.Errorf("Init CRD Backend Failed, ErrorInfo: %s", err.Error())
+	}
+	backend = b
+	return nil
+}
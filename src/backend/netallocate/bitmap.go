@@ -0,0 +1,44 @@
+package netallocate
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// 地址池分配状态, 第i位为1表示子网内第i个地址已分配
+// 以base64存放, etcd后端为<prefix>/groups/<ipgroup>/bitmap, CRD后端为IPPool对象的status.bitmap
+type bitmap []byte
+
+func newBitmap(size uint32) bitmap {
+	return make(bitmap, (size+7)/8)
+}
+
+func decodeBitmap(data string, size uint32) (bitmap, error) {
+	if data == "" {
+		return newBitmap(size), nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("Decode Bitmap Failed, ErrorInfo: %s", err.Error())
+	}
+	bm := newBitmap(size)
+	// 子网调整后位图长度可能不一致, 以当前子网大小为准
+	copy(bm, raw)
+	return bm, nil
+}
+
+func (b bitmap) encode() string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (b bitmap) test(i uint32) bool {
+	return b[i/8]&(1<<(i%8)) != 0
+}
+
+func (b bitmap) set(i uint32) {
+	b[i/8] |= 1 << (i % 8)
+}
+
+func (b bitmap) clear(i uint32) {
+	b[i/8] &^= 1 << (i % 8)
+}
@@ -0,0 +1,86 @@
+package netallocate
+
+import (
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	cases := []struct {
+		name string
+		size uint32
+		set  []uint32
+	}{
+		{name: "empty", size: 256},
+		{name: "first and last", size: 256, set: []uint32{0, 255}},
+		{name: "byte boundaries", size: 64, set: []uint32{7, 8, 15, 16, 63}},
+		{name: "size not multiple of 8", size: 12, set: []uint32{3, 11}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bm := newBitmap(c.size)
+			if len(bm) != int((c.size+7)/8) {
+				t.Fatalf("len = %d, want %d", len(bm), (c.size+7)/8)
+			}
+			isSet := make(map[uint32]bool)
+			for _, i := range c.set {
+				bm.set(i)
+				isSet[i] = true
+			}
+
+			decoded, err := decodeBitmap(bm.encode(), c.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := uint32(0); i < c.size; i++ {
+				if decoded.test(i) != isSet[i] {
+					t.Fatalf("test(%d) = %v after decode, want %v", i, decoded.test(i), isSet[i])
+				}
+			}
+
+			for _, i := range c.set {
+				decoded.clear(i)
+				if decoded.test(i) {
+					t.Fatalf("bit %d still set after clear", i)
+				}
+			}
+			for i := range decoded {
+				if decoded[i] != 0 {
+					t.Fatalf("byte %d = %08b after clearing all bits", i, decoded[i])
+				}
+			}
+		})
+	}
+}
+
+// 子网调整后位图长度与子网大小不一致, 以当前子网大小为准
+func TestDecodeBitmapResize(t *testing.T) {
+	small := newBitmap(16)
+	small.set(3)
+	grown, err := decodeBitmap(small.encode(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grown) != 8 || !grown.test(3) || grown.test(40) {
+		t.Fatalf("grown bitmap = %v", grown)
+	}
+
+	large := newBitmap(64)
+	large.set(3)
+	large.set(40)
+	shrunk, err := decodeBitmap(large.encode(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shrunk) != 2 || !shrunk.test(3) {
+		t.Fatalf("shrunk bitmap = %v", shrunk)
+	}
+
+	empty, err := decodeBitmap("", 16)
+	if err != nil || len(empty) != 2 || empty.test(0) {
+		t.Fatalf("empty bitmap = %v, err = %v", empty, err)
+	}
+
+	if _, err := decodeBitmap("not base64!", 16); err == nil {
+		t.Fatal("expected error for invalid data")
+	}
+}
@@ -0,0 +1,471 @@
+package netallocate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"sort"
+	"strings"
+	"util/log"
+)
+
+// CRD定义见crd.yml, 两种资源都是集群级别
+const (
+	crdGroup   = "multivlancni.io"
+	crdVersion = "v1"
+
+	ipGroupLabel     = crdGroup + "/ipgroup"
+	containerIdLabel = crdGroup + "/container-id"
+
+	// label的值最长63个字符
+	maxLabelValueLen = 63
+)
+
+var (
+	ipPoolResource       = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "ippools"}
+	ipAllocationResource = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "ipallocations"}
+)
+
+// IPPool对象, 名称为ipgroup, 位图和固定IP的保留记录存放在status中
+type ipPoolObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              Pool         `json:"spec"`
+	Status            ipPoolStatus `json:"status,omitempty"`
+}
+
+type ipPoolStatus struct {
+	Bitmap string `json:"bitmap,omitempty"`
+	// key为<namespace>/<podname>
+	Sticky map[string]*StickyReservation `json:"sticky,omitempty"`
+}
+
+// IPAllocation对象, 名称为<ipgroup>-<ip>, 如app-10-10-0-5
+// 容器使用该IP期间Attachment不为空
+type ipAllocationObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ipAllocationSpec `json:"spec"`
+}
+
+type ipAllocationSpec struct {
+	IpGroup string `json:"ipGroup"`
+	Allocation
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// 之前的分配记录, 按分配时间升序
+	History []Allocation `json:"history,omitempty"`
+}
+
+// CRD后端, 所有写操作以resourceVersion做乐观锁
+type crdBackend struct {
+	pools       dynamic.ResourceInterface
+	allocations dynamic.ResourceInterface
+}
+
+func newCrdBackend(config *rest.Config) (*crdBackend, error) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &crdBackend{
+		pools:       client.Resource(ipPoolResource),
+		allocations: client.Resource(ipAllocationResource),
+	}, nil
+}
+
+func allocationName(ipGroup, ip string) string {
+	return ipGroup + "-" + strings.Replace(strings.Split(ip, "/")[0], ".", "-", -1)
+}
+
+func containerIdLabelValue(containerId string) string {
+	if len(containerId) > maxLabelValueLen {
+		return containerId[:maxLabelValueLen]
+	}
+	return containerId
+}
+
+func fromUnstructured(u *unstructured.Unstructured, v interface{}) error {
+	data, err := u.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Unmarshal %s: %s Failed, ErrorInfo: %s", u.GetKind(), u.GetName(), err.Error())
+	}
+	return nil
+}
+
+func toUnstructured(v interface{}) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (b *crdBackend) getPool(ctx context.Context, ipGroup string) (*ipPoolObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u, err := b.pools.Get(ipGroup, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &ipPoolObject{}
+	if err := fromUnstructured(u, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// 以merge patch更新IPPool, patch中带resourceVersion时由apiserver校验版本, 不一致返回false
+func (b *crdBackend) patchPool(ctx context.Context, ipGroup, resourceVersion string, status map[string]interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	patch := map[string]interface{}{"status": status}
+	if resourceVersion != "" {
+		patch["metadata"] = map[string]interface{}{"resourceVersion": resourceVersion}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return false, err
+	}
+	_, err = b.pools.Patch(ipGroup, types.MergePatchType, data, metav1.PatchOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *crdBackend) GetPool(ctx context.Context, ipGroup string) (*Pool, error) {
+	obj, err := b.getPool(ctx, ipGroup)
+	if err != nil {
+		return nil, err
+	}
+	return &obj.Spec, nil
+}
+
+func (b *crdBackend) ListGroups(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := b.pools.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(list.Items))
+	for i := range list.Items {
+		groups = append(groups, list.Items[i].GetName())
+	}
+	return groups, nil
+}
+
+func (b *crdBackend) GetBitmap(ctx context.Context, ipGroup string) (string, string, error) {
+	obj, err := b.getPool(ctx, ipGroup)
+	if err != nil {
+		return "", "", err
+	}
+	return obj.Status.Bitmap, obj.ResourceVersion, nil
+}
+
+// IPPool与IPAllocation是不同的对象, 无法原子写入, 位图写入成功后再写分配记录
+// 分配记录写入失败时只记录日志, 由Assign随后的SaveAllocation补写
+func (b *crdBackend) SwapBitmap(ctx context.Context, ipGroup, data, version string, claim *Allocation) (bool, error) {
+	swapped, err := b.patchPool(ctx, ipGroup, version, map[string]interface{}{"bitmap": data})
+	if err != nil || !swapped || claim == nil {
+		return swapped, err
+	}
+	if err := b.SaveAllocation(ctx, ipGroup, claim); err != nil {
+		log.Warnf("写入IP: %s 的分配记录失败, 错误信息: %s", claim.Ip, err.Error())
+	}
+	return true, nil
+}
+
+func (b *crdBackend) GetVlanMap(ctx context.Context) (map[string]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := b.pools.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]int)
+	for i := range list.Items {
+		obj := &ipPoolObject{}
+		if err := fromUnstructured(&list.Items[i], obj); err != nil {
+			return nil, err
+		}
+		if obj.Spec.VlanId == 0 {
+			continue
+		}
+		if vlanId, ok := raw[obj.Spec.Subnet]; ok && vlanId != obj.Spec.VlanId {
+			return nil, fmt.Errorf("Subnet: %s Mapped To Both Vlan %d And %d", obj.Spec.Subnet, vlanId, obj.Spec.VlanId)
+		}
+		raw[obj.Spec.Subnet] = obj.Spec.VlanId
+	}
+	return raw, nil
+}
+
+// 读取IPAllocation后由update修改并写回, 不存在时创建, 版本冲突时重试
+// update返回false表示无需写入
+func (b *crdBackend) updateAllocation(ctx context.Context, ipGroup, ip string, update func(obj *ipAllocationObject) bool) error {
+	name := allocationName(ipGroup, ip)
+	for i := 0; i < poolUpdateRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		obj := &ipAllocationObject{}
+		u, err := b.allocations.Get(name, metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		switch {
+		case create:
+			obj.APIVersion = crdGroup + "/" + crdVersion
+			obj.Kind = "IPAllocation"
+			obj.Name = name
+			obj.Labels = map[string]string{ipGroupLabel: ipGroup}
+			obj.Spec.IpGroup = ipGroup
+		case err != nil:
+			return err
+		default:
+			if err := fromUnstructured(u, obj); err != nil {
+				return err
+			}
+		}
+
+		if !update(obj) {
+			return nil
+		}
+		if u, err = toUnstructured(obj); err != nil {
+			return err
+		}
+		if create {
+			_, err = b.allocations.Create(u, metav1.CreateOptions{})
+		} else {
+			_, err = b.allocations.Update(u, metav1.UpdateOptions{})
+		}
+		if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+			log.Warnf("IPAllocation: %s 已被其他节点修改, 第%d次重试", name, i+1)
+			if err := conflictBackoff(ctx, i); err != nil {
+				return err
+			}
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("Update IPAllocation: %s Failed, ErrorInfo: Too Many Conflicts", name)
+}
+
+func (b *crdBackend) SaveAllocation(ctx context.Context, ipGroup string, a *Allocation) error {
+	return b.updateAllocation(ctx, ipGroup, a.Ip, func(obj *ipAllocationObject) bool {
+		obj.Spec.Allocation = *a
+		return true
+	})
+}
+
+func (b *crdBackend) GetAllocation(ctx context.Context, ipGroup, ip string) (*Allocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u, err := b.allocations.Get(allocationName(ipGroup, ip), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &ipAllocationObject{}
+	if err := fromUnstructured(u, obj); err != nil {
+		return nil, err
+	}
+	return &obj.Spec.Allocation, nil
+}
+
+// 只有Attachment没有分配记录的对象跳过
+func (b *crdBackend) ListAllocations(ctx context.Context, ipGroup string) ([]*Allocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := b.allocations.List(metav1.ListOptions{
+		LabelSelector: ipGroupLabel + "=" + ipGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var allocations []*Allocation
+	for i := range list.Items {
+		obj := &ipAllocationObject{}
+		if err := fromUnstructured(&list.Items[i], obj); err != nil {
+			return nil, err
+		}
+		if obj.Spec.Ip == "" {
+			continue
+		}
+		a := obj.Spec.Allocation
+		allocations = append(allocations, &a)
+	}
+	return allocations, nil
+}
+
+func (b *crdBackend) SaveHistory(ctx context.Context, ipGroup string, a *Allocation) error {
+	return b.updateAllocation(ctx, ipGroup, a.Ip, func(obj *ipAllocationObject) bool {
+		history := obj.Spec.History
+		i := sort.Search(len(history), func(i int) bool {
+			return !history[i].AllocatedAt.Before(a.AllocatedAt)
+		})
+		if i < len(history) && history[i].AllocatedAt.Equal(a.AllocatedAt) {
+			history[i] = *a
+		} else {
+			history = append(history, Allocation{})
+			copy(history[i+1:], history[i:])
+			history[i] = *a
+		}
+		if len(history) > maxAllocationHistory {
+			history = history[len(history)-maxAllocationHistory:]
+		}
+		obj.Spec.History = history
+		return true
+	})
+}
+
+func (b *crdBackend) ListHistory(ctx context.Context, ipGroup, ip string) ([]*Allocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	u, err := b.allocations.Get(allocationName(ipGroup, ip), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &ipAllocationObject{}
+	if err := fromUnstructured(u, obj); err != nil {
+		return nil, err
+	}
+	history := make([]*Allocation, 0, len(obj.Spec.History))
+	for i := range obj.Spec.History {
+		history = append(history, &obj.Spec.History[i])
+	}
+	return history, nil
+}
+
+func (b *crdBackend) SaveSticky(ctx context.Context, ipGroup string, r *StickyReservation) error {
+	key := r.PodNamespace + "/" + r.PodName
+	_, err := b.patchPool(ctx, ipGroup, "", map[string]interface{}{
+		"sticky": map[string]interface{}{key: r},
+	})
+	return err
+}
+
+func (b *crdBackend) ListSticky(ctx context.Context, ipGroup string) ([]*StickyReservation, error) {
+	obj, err := b.getPool(ctx, ipGroup)
+	if err != nil {
+		return nil, err
+	}
+	reservations := make([]*StickyReservation, 0, len(obj.Status.Sticky))
+	for _, r := range obj.Status.Sticky {
+		reservations = append(reservations, r)
+	}
+	return reservations, nil
+}
+
+func (b *crdBackend) TakeSticky(ctx context.Context, ipGroup, podNamespace, podName string) (*StickyReservation, error) {
+	key := podNamespace + "/" + podName
+	for i := 0; i < poolUpdateRetries; i++ {
+		obj, err := b.getPool(ctx, ipGroup)
+		if err != nil {
+			return nil, err
+		}
+		r := obj.Status.Sticky[key]
+		if r == nil {
+			return nil, nil
+		}
+		// 以读取时的版本删除保留记录, 期间IPPool被修改时重新读取
+		taken, err := b.patchPool(ctx, ipGroup, obj.ResourceVersion, map[string]interface{}{
+			"sticky": map[string]interface{}{key: nil},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return r, nil
+		}
+		log.Warnf("IPPool: %s 已被其他节点修改, 取回Pod: %s 的保留IP第%d次重试", ipGroup, key, i+1)
+		if err := conflictBackoff(ctx, i); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Take Sticky Reservation Of Pod: %s Failed, ErrorInfo: Too Many Conflicts", key)
+}
+
+func (b *crdBackend) SaveAttachment(ctx context.Context, a *Attachment) error {
+	return b.updateAllocation(ctx, a.IpGroup, a.Ip, func(obj *ipAllocationObject) bool {
+		obj.Spec.Attachment = a
+		if obj.Labels == nil {
+			obj.Labels = map[string]string{}
+		}
+		obj.Labels[containerIdLabel] = containerIdLabelValue(a.ContainerId)
+		return true
+	})
+}
+
+// 按containerid的label查找, label值可能被截断, 需要再比较完整的containerid
+func (b *crdBackend) GetAttachment(ctx context.Context, containerId, ifName string) (*Attachment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	list, err := b.allocations.List(metav1.ListOptions{
+		LabelSelector: containerIdLabel + "=" + containerIdLabelValue(containerId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range list.Items {
+		obj := &ipAllocationObject{}
+		if err := fromUnstructured(&list.Items[i], obj); err != nil {
+			return nil, err
+		}
+		a := obj.Spec.Attachment
+		if a != nil && a.ContainerId == containerId && a.IfName == ifName {
+			return a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (b *crdBackend) DelAttachment(ctx context.Context, containerId, ifName string) error {
+	a, err := b.GetAttachment(ctx, containerId, ifName)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.updateAllocation(ctx, a.IpGroup, a.Ip, func(obj *ipAllocationObject) bool {
+		current := obj.Spec.Attachment
+		if current == nil || current.ContainerId != containerId || current.IfName != ifName {
+			return false
+		}
+		obj.Spec.Attachment = nil
+		delete(obj.Labels, containerIdLabel)
+		return true
+	})
+}
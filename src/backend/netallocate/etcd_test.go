@@ -0,0 +1,143 @@
+package netallocate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/etcd/embed"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+	"util/etcdclient"
+)
+
+// 本机空闲端口的URL
+func freeUrl(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// 启动单节点的内嵌etcd并切换到etcd后端, 测试结束后关闭并恢复
+func useEtcdBackend(t *testing.T, prefix string) {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.Logger = "zap"
+	cfg.LogLevel = "error"
+	clientUrl, peerUrl := freeUrl(t), freeUrl(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientUrl}, []url.URL{clientUrl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerUrl}, []url.URL{peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("embedded etcd not ready")
+	}
+
+	prevClient, prevBackend := etcdclient.Etcdclient, backend
+	if err = etcdclient.ClientInitWithOptions(&etcdclient.Options{
+		Endpoints:      []string{clientUrl.String()},
+		DialTimeout:    4,
+		RequestTimeout: 4,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	client := etcdclient.Etcdclient
+	t.Cleanup(func() {
+		client.Client.Close()
+		etcdclient.Etcdclient, backend = prevClient, prevBackend
+	})
+	if err = UseEtcd(prefix); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 经由真实的etcd事务并发分配, 位图与分配记录在同一事务中写入, 不会分配出重复的IP
+func TestEtcdIpAllocateConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts an embedded etcd")
+	}
+	const prefix = "/test"
+	useEtcdBackend(t, prefix)
+	ctx := context.Background()
+	data, err := json.Marshal(&Pool{Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = etcdclient.Etcdclient.Put(ctx, prefix+"/groups/app/pool", string(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 30
+	ips := make([]string, workers)
+	errs := make([]error, workers)
+	owners := make([]*Allocation, workers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		owners[i] = &Allocation{ContainerId: fmt.Sprintf("c%d", i), IfName: "eth0", AllocatedAt: time.Now()}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			ips[i], _, errs[i] = IpAllocate(ctx, "app", nil, owners[i])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	owner := make(map[string]int)
+	for i, ip := range ips {
+		if errs[i] != nil {
+			t.Fatalf("worker %d: %v", i, errs[i])
+		}
+		if j, dup := owner[ip]; dup {
+			t.Fatalf("worker %d and %d both got %s", j, i, ip)
+		}
+		owner[ip] = i
+		a, err := backend.GetAllocation(ctx, "app", ip)
+		if err != nil {
+			t.Fatalf("allocation of %s: %v", ip, err)
+		}
+		if a.ContainerId != owners[i].ContainerId {
+			t.Fatalf("allocation of %s owned by %s, want %s", ip, a.ContainerId, owners[i].ContainerId)
+		}
+	}
+
+	encoded, _, err := backend.GetBitmap(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm, err := decodeBitmap(encoded, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := 0
+	for i := uint32(0); i < 256; i++ {
+		if bm.test(i) {
+			set++
+		}
+	}
+	if set != workers {
+		t.Fatalf("bitmap has %d bits set, want %d", set, workers)
+	}
+
+	// 归还后位图清零, 再次分配可以复用
+	if err = IpRelease(ctx, "app", ips[0]); err != nil {
+		t.Fatal(err)
+	}
+	ip, _, err := IpAllocate(ctx, "app", []string{ips[0]}, nil)
+	if err != nil || ip != ips[0] {
+		t.Fatalf("got %s, %v, want %s", ip, err, ips[0])
+	}
+}
@@ -0,0 +1,276 @@
+package netallocate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"util/etcdclient"
+	"util/log"
+)
+
+// etcd后端的默认key前缀
+const DefaultEtcdPrefix = "/multivlancni"
+
+// kube-apiserver使用的前缀, 不允许与之重叠
+const apiserverEtcdPrefix = "/registry"
+
+// etcd后端, key布局见README
+type etcdBackend struct {
+	prefix string
+}
+
+// 前缀必须以/开头且不以/结尾, 不能位于/registry下
+func ValidateEtcdPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "//") {
+		return fmt.Errorf("invalid etcd prefix: %s, must start with / and not end with /", prefix)
+	}
+	if prefix == apiserverEtcdPrefix || strings.HasPrefix(prefix, apiserverEtcdPrefix+"/") {
+		return fmt.Errorf("invalid etcd prefix: %s, %s is reserved for kube-apiserver", prefix, apiserverEtcdPrefix)
+	}
+	return nil
+}
+
+func (b *etcdBackend) groupKey(ipGroup, name string) string {
+	return b.prefix + "/groups/" + ipGroup + "/" + name
+}
+
+func (b *etcdBackend) allocationKey(ipGroup, ip string) string {
+	return b.groupKey(ipGroup, "allocations/"+strings.Split(ip, "/")[0])
+}
+
+// 分配时间补零到固定长度, 按key排序即按时间排序
+func (b *etcdBackend) historyPrefix(ipGroup, ip string) string {
+	return b.groupKey(ipGroup, "history/"+strings.Split(ip, "/")[0]+"/")
+}
+
+func (b *etcdBackend) historyKey(ipGroup string, a *Allocation) string {
+	return b.historyPrefix(ipGroup, a.Ip) + fmt.Sprintf("%019d", a.AllocatedAt.UnixNano())
+}
+
+func (b *etcdBackend) stickyKey(ipGroup, podNamespace, podName string) string {
+	return b.groupKey(ipGroup, "sticky/"+podNamespace+"/"+podName)
+}
+
+func (b *etcdBackend) attachmentKey(containerId, ifName string) string {
+	return b.prefix + "/attachments/" + containerId + "/" + ifName
+}
+
+func (b *etcdBackend) vlanMapKey() string {
+	return b.prefix + "/vlanmap"
+}
+
+// 读取并解析key的JSON内容, key不存在时返回ErrNotFound
+func (b *etcdBackend) getJson(ctx context.Context, key string, v interface{}) (int64, error) {
+	data, modRevision, err := etcdclient.Etcdclient.GetWithRevision(ctx, key)
+	if etcdclient.IsKeyNotFound(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		log.Errorf("解析etcd记录失败, key: %s, 内容: %s", key, data)
+		return 0, fmt.Errorf("Unmarshal Key: %s Failed, ErrorInfo: %s", key, err.Error())
+	}
+	return modRevision, nil
+}
+
+func (b *etcdBackend) putJson(ctx context.Context, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Marshal Key: %s Failed, ErrorInfo: %s", key, err.Error())
+	}
+	return etcdclient.Etcdclient.Put(ctx, key, string(data))
+}
+
+func (b *etcdBackend) GetPool(ctx context.Context, ipGroup string) (*Pool, error) {
+	p := &Pool{}
+	_, err := b.getJson(ctx, b.groupKey(ipGroup, "pool"), p)
+	if err == ErrNotFound {
+		if legacyErr := legacyPoolCheck(ctx, ipGroup); legacyErr != nil {
+			return nil, legacyErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 地址池定义的key为<prefix>/groups/<ipgroup>/pool
+func (b *etcdBackend) ListGroups(ctx context.Context) ([]string, error) {
+	groupsPrefix := b.prefix + "/groups/"
+	keys, err := etcdclient.Etcdclient.ListKeys(ctx, groupsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, groupsPrefix), "/")
+		if len(parts) == 2 && parts[1] == "pool" {
+			groups = append(groups, parts[0])
+		}
+	}
+	return groups, nil
+}
+
+// 按前缀读取并逐条解析JSON, newItem返回用于解析的新对象
+func (b *etcdBackend) listJson(ctx context.Context, prefix string, newItem func() interface{}) error {
+	kvs, err := etcdclient.Etcdclient.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := json.Unmarshal([]byte(kv.Value), newItem()); err != nil {
+			log.Errorf("解析etcd记录失败, key: %s, 内容: %s", kv.Key, kv.Value)
+			return fmt.Errorf("Unmarshal Key: %s Failed, ErrorInfo: %s", kv.Key, err.Error())
+		}
+	}
+	return nil
+}
+
+func (b *etcdBackend) GetBitmap(ctx context.Context, ipGroup string) (string, string, error) {
+	data, modRevision, err := etcdclient.Etcdclient.GetWithRevision(ctx, b.groupKey(ipGroup, "bitmap"))
+	if etcdclient.IsKeyNotFound(err) {
+		// 旧版本iprange未转换时不能视为全部空闲, 否则会把运行中Pod的IP重复分配出去
+		if err := legacyPoolCheck(ctx, ipGroup); err != nil {
+			return "", "", err
+		}
+		// key不存在时ModRevision为0, 以0为条件即可保证首次写入不覆盖并发写入
+		return "", "0", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return data, strconv.FormatInt(modRevision, 10), nil
+}
+
+func (b *etcdBackend) SwapBitmap(ctx context.Context, ipGroup, data, version string, claim *Allocation) (bool, error) {
+	modRevision, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("Invalid Bitmap Version: %s", version)
+	}
+	bitmapKey := b.groupKey(ipGroup, "bitmap")
+	if claim == nil {
+		return etcdclient.Etcdclient.CompareAndSwap(ctx, bitmapKey, data, modRevision)
+	}
+	// 分配记录与位图在同一事务中写入, 事务超时后可以根据记录判断是否已生效
+	record, err := json.Marshal(claim)
+	if err != nil {
+		return false, fmt.Errorf("Marshal Allocation Of IP: %s Failed, ErrorInfo: %s", claim.Ip, err.Error())
+	}
+	conds := map[string]int64{bitmapKey: modRevision}
+	puts := map[string]string{bitmapKey: data, b.allocationKey(ipGroup, claim.Ip): string(record)}
+	return etcdclient.Etcdclient.CompareAndSwapAll(ctx, conds, puts, nil)
+}
+
+func (b *etcdBackend) GetVlanMap(ctx context.Context) (map[string]int, error) {
+	raw := make(map[string]int)
+	if _, err := b.getJson(ctx, b.vlanMapKey(), &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (b *etcdBackend) SaveAllocation(ctx context.Context, ipGroup string, a *Allocation) error {
+	return b.putJson(ctx, b.allocationKey(ipGroup, a.Ip), a)
+}
+
+func (b *etcdBackend) GetAllocation(ctx context.Context, ipGroup, ip string) (*Allocation, error) {
+	a := &Allocation{}
+	if _, err := b.getJson(ctx, b.allocationKey(ipGroup, ip), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (b *etcdBackend) ListAllocations(ctx context.Context, ipGroup string) ([]*Allocation, error) {
+	var allocations []*Allocation
+	err := b.listJson(ctx, b.groupKey(ipGroup, "allocations/"), func() interface{} {
+		a := &Allocation{}
+		allocations = append(allocations, a)
+		return a
+	})
+	return allocations, err
+}
+
+func (b *etcdBackend) SaveHistory(ctx context.Context, ipGroup string, a *Allocation) error {
+	if err := b.putJson(ctx, b.historyKey(ipGroup, a), a); err != nil {
+		return err
+	}
+	keys, err := etcdclient.Etcdclient.ListKeys(ctx, b.historyPrefix(ipGroup, a.Ip))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(keys)-maxAllocationHistory; i++ {
+		if err := etcdclient.Etcdclient.Delete(ctx, keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *etcdBackend) ListHistory(ctx context.Context, ipGroup, ip string) ([]*Allocation, error) {
+	var history []*Allocation
+	err := b.listJson(ctx, b.historyPrefix(ipGroup, ip), func() interface{} {
+		a := &Allocation{}
+		history = append(history, a)
+		return a
+	})
+	return history, err
+}
+
+func (b *etcdBackend) SaveSticky(ctx context.Context, ipGroup string, r *StickyReservation) error {
+	return b.putJson(ctx, b.stickyKey(ipGroup, r.PodNamespace, r.PodName), r)
+}
+
+func (b *etcdBackend) ListSticky(ctx context.Context, ipGroup string) ([]*StickyReservation, error) {
+	var reservations []*StickyReservation
+	err := b.listJson(ctx, b.groupKey(ipGroup, "sticky/"), func() interface{} {
+		r := &StickyReservation{}
+		reservations = append(reservations, r)
+		return r
+	})
+	return reservations, err
+}
+
+func (b *etcdBackend) TakeSticky(ctx context.Context, ipGroup, podNamespace, podName string) (*StickyReservation, error) {
+	key := b.stickyKey(ipGroup, podNamespace, podName)
+	r := &StickyReservation{}
+	modRevision, err := b.getJson(ctx, key, r)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 删除保留记录成功才算取回, 避免并发的ADD重复使用同一个IP
+	claimed, err := etcdclient.Etcdclient.CompareAndDelete(ctx, key, modRevision)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		log.Warnf("Pod: %s/%s 的保留IP已被其他请求取回", podNamespace, podName)
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (b *etcdBackend) SaveAttachment(ctx context.Context, a *Attachment) error {
+	return b.putJson(ctx, b.attachmentKey(a.ContainerId, a.IfName), a)
+}
+
+func (b *etcdBackend) GetAttachment(ctx context.Context, containerId, ifName string) (*Attachment, error) {
+	a := &Attachment{}
+	if _, err := b.getJson(ctx, b.attachmentKey(containerId, ifName), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (b *etcdBackend) DelAttachment(ctx context.Context, containerId, ifName string) error {
+	return etcdclient.Etcdclient.Delete(ctx, b.attachmentKey(containerId, ifName))
+}
@@ -0,0 +1,222 @@
+package netallocate
+
+import (
+	"context"
+	"time"
+	"util/log"
+)
+
+// 回收占用者已不存在的IP, 以及过期未被取回的固定IP保留记录
+// 调用方负责保证同一时间只有一个GC在运行
+
+// 判断分配记录的占用者是否仍然存在, 返回false时reason说明原因
+type OwnerChecker func(ctx context.Context, a *Allocation) (alive bool, reason string, err error)
+
+type GcOptions struct {
+	// 分配时间不足GracePeriod的记录不回收, 避免与进行中的ADD冲突
+	GracePeriod time.Duration
+	// 每秒最多回收的数量, 0表示不限制
+	Rate float64
+	// 单次最多回收的数量, 0表示不限制
+	MaxReleases int
+	// 只报告不回收
+	DryRun     bool
+	OwnerAlive OwnerChecker
+}
+
+// GC动作
+const (
+	GcActionRelease = "release"
+	// 开启固定IP的Pod, IP转为保留记录, 到期后再回收
+	GcActionReserve = "reserve"
+	// 回收过期的固定IP保留记录
+	GcActionSweepSticky = "sweep-sticky"
+)
+
+type GcRecord struct {
+	IpGroup      string
+	Ip           string
+	PodNamespace string
+	PodName      string
+	ContainerId  string
+	Action       string
+	Reason       string
+	// DryRun时为空, 回收失败时为错误信息
+	Error string
+}
+
+type GcResult struct {
+	Scanned  int
+	Orphaned int
+	Released int
+	Failed   int
+	// MaxReleases达到上限后未处理的记录数
+	Deferred int
+	Records  []GcRecord
+}
+
+type gcRun struct {
+	opts        *GcOptions
+	result      *GcResult
+	lastRelease time.Time
+}
+
+// groups为空时处理所有地址池, 单条记录回收失败只记录在结果中, 读取失败时返回错误
+func CollectGarbage(ctx context.Context, groups []string, opts *GcOptions) (*GcResult, error) {
+	if len(groups) == 0 {
+		var err error
+		if groups, err = backend.ListGroups(ctx); err != nil {
+			log.Errorf("获取地址池列表失败, 错误信息: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	run := &gcRun{opts: opts, result: &GcResult{}}
+	for _, ipGroup := range groups {
+		if err := run.collectAllocations(ctx, ipGroup); err != nil {
+			return run.result, err
+		}
+		if err := run.sweepSticky(ctx, ipGroup); err != nil {
+			return run.result, err
+		}
+	}
+	return run.result, nil
+}
+
+func (g *gcRun) collectAllocations(ctx context.Context, ipGroup string) error {
+	allocations, err := backend.ListAllocations(ctx, ipGroup)
+	if err != nil {
+		log.Errorf("获取地址池: %s 的分配记录失败, 错误信息: %s", ipGroup, err.Error())
+		return err
+	}
+	now := time.Now()
+	for _, a := range allocations {
+		if a.ReleasedAt != nil {
+			continue
+		}
+		g.result.Scanned++
+		// 没有Pod信息的记录无法判断占用者, 不处理; 旧版本转换的占位记录由OwnerAlive按IP核对
+		if (a.PodName == "" && a.ContainerId != LegacyContainerId) || now.Sub(a.AllocatedAt) < g.opts.GracePeriod {
+			continue
+		}
+		alive, reason, err := g.opts.OwnerAlive(ctx, a)
+		if err != nil {
+			return err
+		}
+		if alive {
+			continue
+		}
+
+		g.result.Orphaned++
+		record := GcRecord{
+			IpGroup:      ipGroup,
+			Ip:           a.Ip,
+			PodNamespace: a.PodNamespace,
+			PodName:      a.PodName,
+			ContainerId:  a.ContainerId,
+			Action:       GcActionRelease,
+			Reason:       reason,
+		}
+		attachment, err := GetAttachment(ctx, a.ContainerId, a.IfName)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if attachment != nil && (attachment.IpGroup != ipGroup || attachment.Ip != a.Ip) {
+			attachment = nil
+		}
+		if attachment != nil && attachment.Sticky {
+			record.Action = GcActionReserve
+		}
+		// 与DEL的回收流程一致
+		if !g.apply(ctx, &record, func() error { return unassign(ctx, ipGroup, a.Ip, a.ContainerId, attachment) }) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// 保留记录只在同名Pod重建时才会被取回, 过期后由GC归还到地址池
+func (g *gcRun) sweepSticky(ctx context.Context, ipGroup string) error {
+	reservations, err := backend.ListSticky(ctx, ipGroup)
+	if err != nil {
+		log.Errorf("获取地址池: %s 的固定IP保留记录失败, 错误信息: %s", ipGroup, err.Error())
+		return err
+	}
+	for _, r := range reservations {
+		if time.Now().Before(r.ExpiresAt) {
+			continue
+		}
+		record := GcRecord{
+			IpGroup:      ipGroup,
+			Ip:           r.Ip,
+			PodNamespace: r.PodNamespace,
+			PodName:      r.PodName,
+			Action:       GcActionSweepSticky,
+			Reason:       "reservation expired at " + r.ExpiresAt.Format(time.RFC3339),
+		}
+		if !g.apply(ctx, &record, func() error { return sweepReservation(ctx, ipGroup, r) }) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// 取出后再次确认已过期, 期间同名Pod重建后又被删除时保留记录是新的, 需要放回
+func sweepReservation(ctx context.Context, ipGroup string, listed *StickyReservation) error {
+	r, err := backend.TakeSticky(ctx, ipGroup, listed.PodNamespace, listed.PodName)
+	if err != nil || r == nil {
+		return err
+	}
+	if time.Now().Before(r.ExpiresAt) {
+		return UnclaimSticky(ctx, ipGroup, r)
+	}
+	return IpRelease(ctx, ipGroup, r.Ip)
+}
+
+// 按限速执行回收并记录结果, ctx结束时返回false
+func (g *gcRun) apply(ctx context.Context, record *GcRecord, release func() error) bool {
+	defer func() {
+		g.result.Records = append(g.result.Records, *record)
+	}()
+	if g.opts.DryRun {
+		log.Infof("[dry-run] 地址池: %s, IP: %s, Pod: %s/%s, 动作: %s, 原因: %s", record.IpGroup, record.Ip, record.PodNamespace, record.PodName, record.Action, record.Reason)
+		return true
+	}
+	if g.opts.MaxReleases > 0 && g.result.Released+g.result.Failed >= g.opts.MaxReleases {
+		g.result.Deferred++
+		record.Error = "deferred, max releases reached"
+		return true
+	}
+	if !g.wait(ctx) {
+		record.Error = ctx.Err().Error()
+		return false
+	}
+
+	if err := release(); err != nil {
+		g.result.Failed++
+		record.Error = err.Error()
+		log.Errorf("GC回收地址池: %s 的IP: %s 失败, 错误信息: %s", record.IpGroup, record.Ip, err.Error())
+		return ctx.Err() == nil
+	}
+	g.result.Released++
+	log.Infof("GC回收地址池: %s 的IP: %s, Pod: %s/%s, 动作: %s, 原因: %s", record.IpGroup, record.Ip, record.PodNamespace, record.PodName, record.Action, record.Reason)
+	return true
+}
+
+// 两次回收之间至少间隔1/Rate秒
+func (g *gcRun) wait(ctx context.Context) bool {
+	if g.opts.Rate > 0 && !g.lastRelease.IsZero() {
+		interval := time.Duration(float64(time.Second) / g.opts.Rate)
+		if delay := interval - time.Since(g.lastRelease); delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return false
+			case <-timer.C:
+			}
+		}
+	}
+	g.lastRelease = time.Now()
+	return true
+}
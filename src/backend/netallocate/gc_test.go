@@ -0,0 +1,51 @@
+package netallocate
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 旧版本转换的占位记录没有Pod信息, 也交给OwnerAlive核对, 没有Pod使用时归还
+func TestCollectGarbageLegacyPlaceholder(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst},
+	})
+	ctx := context.Background()
+	bm := newBitmap(256)
+	bm.set(2)
+	bm.set(3)
+	m.bitmaps["app"] = bm.encode()
+	allocatedAt := time.Now().Add(-time.Hour)
+	for _, ip := range []string{"10.0.0.2/24", "10.0.0.3/24"} {
+		if err := m.SaveAllocation(ctx, "app", &Allocation{Ip: ip, ContainerId: LegacyContainerId, AllocatedAt: allocatedAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := CollectGarbage(ctx, nil, &GcOptions{
+		GracePeriod: time.Minute,
+		OwnerAlive: func(ctx context.Context, a *Allocation) (bool, string, error) {
+			return a.Ip == "10.0.0.2/24", "legacy ip not used by any pod", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Scanned != 2 || result.Released != 1 {
+		t.Fatalf("scanned %d, released %d, want 2 and 1", result.Scanned, result.Released)
+	}
+	if a, _ := m.GetAllocation(ctx, "app", "10.0.0.3/24"); a.ReleasedAt == nil {
+		t.Fatal("placeholder of unused ip not released")
+	}
+	if a, _ := m.GetAllocation(ctx, "app", "10.0.0.2/24"); a.ReleasedAt != nil {
+		t.Fatal("placeholder of used ip released")
+	}
+	current, err := decodeBitmap(m.bitmaps["app"], 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.test(2) || current.test(3) {
+		t.Fatalf("bitmap after gc: .2 set %v, .3 set %v, want true and false", current.test(2), current.test(3))
+	}
+}
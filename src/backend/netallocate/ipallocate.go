@@ -1,83 +1,309 @@
 package netallocate
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/types/current"
+	"math/rand"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"util/log"
-	"util/etcdclient"
 )
 
-func IpAllocate(ipGroup string, ipRange []string) (string, string, error) {
-	/* 从ip范围内选择可以使用的IP地址
-	   逻辑待补充，ip格式为1.1.1.1/23 */
-	key := "/registry/" + ipGroup + "/iprange"
-	podCfgIpRange, err := etcdclient.Etcdclient.Get(key)
+// ipRange与地址池中的空闲IP没有交集时返回
+var ErrNoMatchedIp = errors.New("No Free IP Matches ipv4list")
+
+// 地址池CAS更新冲突时的最大重试次数
+const poolUpdateRetries = 10
+
+// 以版本号为条件更新地址池位图, 位图被其他节点并发修改时重新读取后重试
+// update返回false表示无需写入, claim不为nil时由update填写IP, 与位图一同写入分配记录
+func updateBitmap(ctx context.Context, ipGroup string, pool *Pool, claim *Allocation, update func(bm bitmap) (bool, error)) error {
+	for i := 0; i < poolUpdateRetries; i++ {
+		data, version, err := backend.GetBitmap(ctx, ipGroup)
+		if err != nil {
+			return err
+		}
+		bm, err := decodeBitmap(data, pool.size)
+		if err != nil {
+			return err
+		}
+
+		changed, err := update(bm)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+
+		var prev *Allocation
+		if claim != nil {
+			if prev, err = overwrittenAllocation(ctx, ipGroup, claim); err != nil {
+				return err
+			}
+		}
+		swapped, err := backend.SwapBitmap(ctx, ipGroup, bm.encode(), version, claim)
+		if err != nil && claim != nil && claimApplied(ctx, ipGroup, claim) {
+			log.Warnf("写入地址池: %s 位图返回错误, 但分配记录显示IP: %s 已写入, 错误信息: %s", ipGroup, claim.Ip, err.Error())
+			swapped, err = true, nil
+		}
+		if err != nil {
+			return err
+		}
+		if swapped {
+			// 位图已经写入, 历史记录写入失败不能再让分配失败, 否则IP无人回收
+			if prev != nil {
+				if err := backend.SaveHistory(ctx, ipGroup, prev); err != nil {
+					log.Warnf("写入IP: %s 的历史记录失败, 错误信息: %s", prev.Ip, err.Error())
+				}
+			}
+			return nil
+		}
+		log.Warnf("地址池: %s 已被其他节点修改, 第%d次重试", ipGroup, i+1)
+		if err := conflictBackoff(ctx, i); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Update Bitmap Of Pool: %s Failed, ErrorInfo: Too Many Conflicts", ipGroup)
+}
+
+// 全局rand在Go 1.20之前默认种子固定, 各节点的抖动序列相同, 按进程单独播种
+// rand.Rand不是并发安全的, 以锁保护
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// 乐观锁冲突后第attempt次重试前等待, 随次数增加并加入随机抖动, 避免并发的节点再次同时写入
+func conflictBackoff(ctx context.Context, attempt int) error {
+	jitter.Lock()
+	delay := time.Duration(10*(attempt+1)+jitter.Intn(50)) * time.Millisecond
+	jitter.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// 写入位图的事务超时或连接中断时无法确定是否已生效, 根据同一事务写入的分配记录判断
+// 记录的占用者和分配时间与本次一致即已生效; 无法读取记录时按未生效处理, 已写入的IP有分配记录, 由GC回收
+func claimApplied(ctx context.Context, ipGroup string, claim *Allocation) bool {
+	a, err := backend.GetAllocation(ctx, ipGroup, claim.Ip)
+	if err != nil {
+		return false
+	}
+	return a.ContainerId == claim.ContainerId && a.AllocatedAt.Equal(claim.AllocatedAt) && a.ReleasedAt == nil
+}
+
+func IpAllocate(ctx context.Context, ipGroup string, ipRange []string, owner *Allocation) (string, string, error) {
+	/* 从地址池中选择可以使用的IP地址, 返回格式为1.1.1.1/23
+	   ipRange为空时不做限制, 否则只从ipRange与地址池空闲地址的交集中分配
+	   ipRange中的地址可以不带掩码
+	   owner不为nil时填写Ip后与位图一同写入分配记录, 调用方随后的SaveAllocation会覆盖该记录 */
+	pool, err := GetPool(ctx, ipGroup)
 	if err != nil {
-		log.Errorf("在etcd中无IP段信息，无法分配IP地址")
 		return "", "", err
 	}
-	log.Debugln(podCfgIpRange)
 
-	podCfgIpList := strings.Split(podCfgIpRange, ",")
-        if len(podCfgIpList) == 0 {
-		return "", "", fmt.Errorf("没有可用的地址段")
+	var offset uint32
+	err = updateBitmap(ctx, ipGroup, pool, owner, func(bm bitmap) (bool, error) {
+		// 每次重试都在读取位图之后重新读取归还时间, 与位图的空闲状态保持一致
+		releasedAt, err := releaseTimes(ctx, ipGroup, pool, bm)
+		if err != nil {
+			return false, err
+		}
+		picker := newOffsetPicker(pool, releasedAt)
+		var found bool
+		offset, found = picker.pick(bm, ipRange)
+		if !found {
+			if len(ipRange) > 0 {
+				log.Errorf("地址池: %s 中没有与ipv4列表: %s 匹配的空闲IP, 冷却中的IP: %d个", ipGroup, ipRange, picker.cooling)
+				return false, ErrNoMatchedIp
+			}
+			if picker.cooling > 0 {
+				return false, fmt.Errorf("No Free IP In Pool: %s, %d IPs Are In Release Cooldown", ipGroup, picker.cooling)
+			}
+			return false, fmt.Errorf("No Free IP In Pool: %s", ipGroup)
+		}
+		bm.set(offset)
+		if owner != nil {
+			owner.Ip = pool.cidrOf(pool.base + offset)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", "", err
 	}
-        configIp := podCfgIpList[0]
-        
-	log.Infof("分配到IP地址: %s",configIp)
+	configIp := pool.cidrOf(pool.base + offset)
+	log.Infof("分配到IP地址: %s", configIp)
+
+	configGw := pool.GatewayCidr()
+	log.Infof("IP: %s, 分配的网关地址为: %s", configIp, configGw)
 
+	return configIp, configGw, nil
+}
 
-	/* 根据IP拉取网关信息，这边基于/23位子网掩码进行计算*/
-	netAB := strings.Join(strings.Split(strings.Split(configIp, "/")[0], ".")[0:3], ".")
-	netC := strings.Split(strings.Split(configIp, "/")[0], ".")[3]
-	netCInt, err := strconv.Atoi(netC)
+// 根据分配记录的ReleasedAt获取各IP最近一次归还的时间, 只在开启冷却或lru时读取
+// DEL和GC都是先标记分配记录再归还位图, 位图中空闲而记录未标记归还时归还时间未知, 按刚刚归还处理
+// 没有分配记录的IP从未被使用过
+func releaseTimes(ctx context.Context, ipGroup string, pool *Pool, bm bitmap) (map[uint32]time.Time, error) {
+	if pool.ReleaseCooldown == 0 && pool.Strategy != StrategyLru {
+		return nil, nil
+	}
+	allocations, err := backend.ListAllocations(ctx, ipGroup)
 	if err != nil {
-		log.Errorf("IP: %s, 网关地址数据类型转换失败",configIp )
-		return "", "", fmt.Errorf("网关地址数据类型转换失败")
+		log.Errorf("获取地址池: %s 的分配记录失败, 错误信息: %s", ipGroup, err.Error())
+		return nil, err
 	}
-	if netCInt%2 != 0 {
-		configGw := strings.Join(strings.Split(strings.Split(configIp, "/")[0], ",")[0:2], ".") + "2/24"
-		log.Infof("IP: %s, 分配的网关地址为: %s",configIp, configGw)
-		return configIp, configGw, nil
+	now := time.Now()
+	releasedAt := make(map[uint32]time.Time)
+	for _, a := range allocations {
+		ip, _, err := net.ParseCIDR(a.Ip)
+		if err != nil {
+			continue
+		}
+		offset, ok := pool.offsetOf(ip)
+		if !ok {
+			continue
+		}
+		if a.ReleasedAt != nil {
+			releasedAt[offset] = *a.ReleasedAt
+		} else if !bm.test(offset) {
+			releasedAt[offset] = now
+		}
 	}
-	netCStr := strconv.Itoa(netCInt - 1)
-	configGw := netAB + "." + netCStr + ".2/24"
-	log.Infof("IP: %s, 分配的网关地址为: %s",configIp, configGw)
+	return releasedAt, nil
+}
+
+// 按地址池的冷却时间和分配策略挑选空闲地址
+type offsetPicker struct {
+	pool       *Pool
+	releasedAt map[uint32]time.Time
+	now        time.Time
+	// 因冷却被跳过的空闲地址数量
+	cooling int
+}
+
+func newOffsetPicker(pool *Pool, releasedAt map[uint32]time.Time) *offsetPicker {
+	return &offsetPicker{pool: pool, releasedAt: releasedAt, now: time.Now()}
+}
+
+func (o *offsetPicker) usable(bm bitmap, offset uint32) bool {
+	if !o.pool.allowed(offset) || bm.test(offset) {
+		return false
+	}
+	cooldown := time.Duration(o.pool.ReleaseCooldown) * time.Second
+	if at, ok := o.releasedAt[offset]; ok && o.now.Sub(at) < cooldown {
+		o.cooling++
+		return false
+	}
+	return true
+}
 
-	var ret []string
-	for _, val := range podCfgIpList {
-		if val != configIp {
-			ret = append(ret, val)
+// first策略选出第一个可分配的空闲地址, ipRange不为空时按ipRange顺序挑选
+// lru策略在同样的候选地址中选最久之前归还的, 从未使用过的地址最优先
+func (o *offsetPicker) pick(bm bitmap, ipRange []string) (uint32, bool) {
+	var best uint32
+	found := false
+	// 返回true表示已经选定, 不需要再看后面的候选地址
+	consider := func(offset uint32) bool {
+		if !o.usable(bm, offset) {
+			return false
+		}
+		at, used := o.releasedAt[offset]
+		if o.pool.Strategy != StrategyLru || !used {
+			best, found = offset, true
+			return true
+		}
+		if !found || at.Before(o.releasedAt[best]) {
+			best, found = offset, true
+		}
+		return false
+	}
+
+	if len(ipRange) == 0 {
+		for offset := uint32(0); offset < o.pool.size; offset++ {
+			if consider(offset) {
+				break
+			}
+		}
+		return best, found
+	}
+
+	for _, val := range ipRange {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		offset, ok := o.pool.offsetOf(net.ParseIP(strings.Split(val, "/")[0]))
+		if ok && consider(offset) {
+			break
 		}
 	}
-	
-        podCfgIpStr := strings.Join(ret, ",")
-        log.Infof(podCfgIpStr)
-	err = etcdclient.Etcdclient.Put(key,podCfgIpStr)
+	return best, found
+}
+
+func IpRelease(ctx context.Context, ipGroup, configIp string) error {
+	/* 将IP地址归还到地址池
+	   已经是空闲状态的IP直接跳过, 保证重复调用的幂等性 */
+	pool, err := GetPool(ctx, ipGroup)
 	if err != nil {
-		return "", "", fmt.Errorf("更新IpRange失败")
+		return err
+	}
+	offset, ok := pool.offsetOf(net.ParseIP(strings.Split(configIp, "/")[0]))
+	if !ok {
+		return fmt.Errorf("IP: %s Not In Pool: %s, Subnet: %s", configIp, ipGroup, pool.Subnet)
 	}
 
-	return configIp, configGw, nil
+	// 归还是幂等的, 结果不确定时由调用方重试即可, 不需要写入分配记录
+	err = updateBitmap(ctx, ipGroup, pool, nil, func(bm bitmap) (bool, error) {
+		if !bm.test(offset) {
+			log.Infof("IP: %s 在地址池: %s 中已是空闲状态, 无需归还", configIp, ipGroup)
+			return false, nil
+		}
+		bm.clear(offset)
+		return true, nil
+	})
+	if err != nil {
+		log.Errorf("归还IP: %s 到地址池: %s 失败, 错误信息: %s", configIp, ipGroup, err.Error())
+		return fmt.Errorf("归还IP: %s 到地址池失败", configIp)
+	}
+	log.Infof("IP: %s 已归还到地址池: %s", configIp, ipGroup)
+	return nil
 }
 
-func VlanAllocate(ip string) int {
-	/* 根据IP地址获取VLAN
-	   这里写死，实际需要调用内部平台做hash匹配 */
-	vlanMap := make(map[string]int)
-	vlanMap["192.168.1.1/23"] = 2135
-	vlanId := vlanMap[ip]
-	return vlanId
+func VlanAllocate(ctx context.Context, ipGroup, ip string) (int, error) {
+	/* 根据VLAN映射表按最长前缀匹配获取IP所属VLAN
+	   地址池配置了vlanId时必须与映射表一致 */
+	vlanId, err := LookupVlan(ctx, ip)
+	if err != nil {
+		return 0, err
+	}
+
+	pool, err := GetPool(ctx, ipGroup)
+	if err != nil {
+		return 0, err
+	}
+	if pool.VlanId != 0 && pool.VlanId != vlanId {
+		return 0, fmt.Errorf("VlanId Of Pool: %s Is %d, But Vlan Map Resolves IP: %s To %d", ipGroup, pool.VlanId, ip, vlanId)
+	}
+	log.Infof("IP: %s 匹配到VLAN: %d", ip, vlanId)
+	return vlanId, nil
 }
 
 func IpCfgConv(configIp, configGw string) (*current.IPConfig, error) {
-	_, configIpNet, err := net.ParseCIDR(configIp)
+	ipAddr, configIpNet, err := net.ParseCIDR(configIp)
 	if err != nil {
 		return nil, fmt.Errorf("解析IP地址到ipnet失败")
 	}
+	// ParseCIDR返回的是网段地址, 需要换回主机地址
+	configIpNet.IP = ipAddr
 	configGwIp, _, err := net.ParseCIDR(configGw)
 	if err != nil {
 		return nil, fmt.Errorf("解析GW到netip失败")
@@ -88,3 +314,13 @@ func IpCfgConv(configIp, configGw string) (*current.IPConfig, error) {
 		Gateway: configGwIp,
 	}, nil
 }
+
+// CHECK时判断prevResult中是否包含分配的地址和网关
+func HasIpCfg(ips []*current.IPConfig, ipc *current.IPConfig) bool {
+	for _, prevIpc := range ips {
+		if prevIpc.Address.String() == ipc.Address.String() && prevIpc.Gateway.Equal(ipc.Gateway) {
+			return true
+		}
+	}
+	return false
+}
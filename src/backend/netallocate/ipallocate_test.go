@@ -0,0 +1,236 @@
+package netallocate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOffsetPicker(t *testing.T) {
+	cases := []struct {
+		name     string
+		strategy string
+		cooldown int
+		used     []uint32
+		// 各偏移在多久之前归还
+		released map[uint32]time.Duration
+		ipRange  []string
+		want     uint32
+		found    bool
+		cooling  int
+	}{
+		{name: "first skips network gateway and used", used: []uint32{2}, want: 3, found: true},
+		{name: "cooling skipped", cooldown: 60, released: map[uint32]time.Duration{2: 10 * time.Second}, want: 3, found: true, cooling: 1},
+		{name: "cooldown expired", cooldown: 60, released: map[uint32]time.Duration{2: 2 * time.Minute}, want: 2, found: true},
+		{name: "lru prefers never used", strategy: StrategyLru, released: map[uint32]time.Duration{2: time.Minute, 3: time.Hour}, want: 4, found: true},
+		{name: "lru picks oldest release", strategy: StrategyLru, released: map[uint32]time.Duration{2: time.Minute, 3: time.Hour}, ipRange: []string{"10.0.0.2", "10.0.0.3"}, want: 3, found: true},
+		{name: "lru with cooldown", strategy: StrategyLru, cooldown: 600, released: map[uint32]time.Duration{2: time.Minute, 3: time.Hour}, ipRange: []string{"10.0.0.2", "10.0.0.3"}, want: 3, found: true, cooling: 1},
+		{name: "ipRange order", ipRange: []string{"10.0.0.9", "10.0.0.5"}, want: 9, found: true},
+		{name: "ipRange with mask", ipRange: []string{"10.0.0.7/24"}, want: 7, found: true},
+		{name: "ipRange used", used: []uint32{9}, ipRange: []string{"10.0.0.9", "10.0.0.5"}, want: 5, found: true},
+		{name: "ipRange exhausted", used: []uint32{9}, ipRange: []string{"10.0.0.9", "10.0.1.9", "10.0.0.1"}, found: false},
+		{name: "ipRange cooling", cooldown: 60, released: map[uint32]time.Duration{9: time.Second}, ipRange: []string{"10.0.0.9"}, found: false, cooling: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pool := &Pool{Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst, Strategy: c.strategy, ReleaseCooldown: c.cooldown}
+			if err := pool.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			bm := newBitmap(pool.size)
+			for _, offset := range c.used {
+				bm.set(offset)
+			}
+			now := time.Now()
+			releasedAt := make(map[uint32]time.Time)
+			for offset, ago := range c.released {
+				releasedAt[offset] = now.Add(-ago)
+			}
+
+			picker := &offsetPicker{pool: pool, releasedAt: releasedAt, now: now}
+			got, found := picker.pick(bm, c.ipRange)
+			if found != c.found || (found && got != c.want) {
+				t.Fatalf("pick = %d, %v, want %d, %v", got, found, c.want, c.found)
+			}
+			if picker.cooling != c.cooling {
+				t.Fatalf("cooling = %d, want %d", picker.cooling, c.cooling)
+			}
+		})
+	}
+}
+
+// 多个节点并发分配时依靠位图的CAS保证不会分配出重复的IP
+func TestIpAllocateConcurrent(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst},
+	})
+	m.readDelay = 2 * time.Millisecond
+	const workers = 50
+	ips := make([]string, workers)
+	errs := make([]error, workers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			ips[i], _, errs[i] = IpAllocate(context.Background(), "app", nil, nil)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	owner := make(map[string]int)
+	for i, ip := range ips {
+		if errs[i] != nil {
+			t.Fatalf("worker %d: %v", i, errs[i])
+		}
+		if j, dup := owner[ip]; dup {
+			t.Fatalf("worker %d and %d both got %s", j, i, ip)
+		}
+		owner[ip] = i
+		if ip == "10.0.0.1/24" || ip == "10.0.0.0/24" || ip == "10.0.0.255/24" {
+			t.Fatalf("worker %d got reserved address %s", i, ip)
+		}
+	}
+
+	bm, err := decodeBitmap(m.bitmaps["app"], 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := 0
+	for i := uint32(0); i < 256; i++ {
+		if bm.test(i) {
+			set++
+		}
+	}
+	if set != workers {
+		t.Fatalf("bitmap has %d bits set, want %d", set, workers)
+	}
+	if m.conflicts == 0 {
+		t.Fatal("no cas conflicts, allocations did not run concurrently")
+	}
+	t.Logf("%d allocations, %d cas conflicts", workers, m.conflicts)
+}
+
+func TestIpAllocateExhaustedAndRelease(t *testing.T) {
+	useMemBackend(t, map[string]*Pool{
+		// 可分配的只有.2到.6
+		"small": {Subnet: "10.0.0.0/29", GatewayRule: GatewayRuleFirst},
+	})
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = IpAllocate(ctx, "small", nil, nil)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("worker %d: %v", i, err)
+		}
+	}
+
+	if _, _, err := IpAllocate(ctx, "small", nil, nil); err == nil || !strings.Contains(err.Error(), "No Free IP") {
+		t.Fatalf("expected pool exhausted, got %v", err)
+	}
+	if err := IpRelease(ctx, "small", "10.0.0.4/29"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复归还是幂等的
+	if err := IpRelease(ctx, "small", "10.0.0.4/29"); err != nil {
+		t.Fatal(err)
+	}
+	ip, gw, err := IpAllocate(ctx, "small", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.4/29" || gw != "10.0.0.1/29" {
+		t.Fatalf("got %s via %s, want 10.0.0.4/29 via 10.0.0.1/29", ip, gw)
+	}
+}
+
+func TestIpAllocateRange(t *testing.T) {
+	useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst},
+	})
+	ctx := context.Background()
+	ip, _, err := IpAllocate(ctx, "app", []string{"10.0.0.5"}, nil)
+	if err != nil || ip != "10.0.0.5/24" {
+		t.Fatalf("got %s, %v, want 10.0.0.5/24", ip, err)
+	}
+	if _, _, err = IpAllocate(ctx, "app", []string{"10.0.0.5"}, nil); err != ErrNoMatchedIp {
+		t.Fatalf("got %v, want ErrNoMatchedIp", err)
+	}
+}
+
+// 写入位图的事务超时后根据同一事务写入的分配记录判断是否已生效, 已生效的IP直接认领, 不会泄漏
+func TestIpAllocateAmbiguousSwap(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"app": {Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst},
+	})
+	ctx := context.Background()
+	m.swapErr = errors.New("context deadline exceeded")
+
+	owner := &Allocation{ContainerId: "c1", IfName: "eth0", AllocatedAt: time.Now()}
+	ip, _, err := IpAllocate(ctx, "app", nil, owner)
+	if err != nil || ip != "10.0.0.2/24" || owner.Ip != ip {
+		t.Fatalf("got %s, %v, owner ip %s, want 10.0.0.2/24", ip, err, owner.Ip)
+	}
+
+	// 事务没有生效时返回错误, 位图和分配记录都不变
+	m.swapLost = true
+	_, _, err = IpAllocate(ctx, "app", nil, &Allocation{ContainerId: "c2", IfName: "eth0", AllocatedAt: time.Now()})
+	if err != m.swapErr {
+		t.Fatalf("err = %v, want %v", err, m.swapErr)
+	}
+	if _, err = m.GetAllocation(ctx, "app", "10.0.0.3/24"); err != ErrNotFound {
+		t.Fatalf("unexpected allocation for 10.0.0.3/24: %v", err)
+	}
+
+	m.swapErr = nil
+	ip, _, err = IpAllocate(ctx, "app", nil, nil)
+	if err != nil || ip != "10.0.0.3/24" {
+		t.Fatalf("got %s, %v, want 10.0.0.3/24", ip, err)
+	}
+}
+
+// 位图中空闲但分配记录未标记归还的IP按刚刚归还处理, 冷却期内不分配
+func TestIpAllocateCooldownUnreleasedRecord(t *testing.T) {
+	m := useMemBackend(t, map[string]*Pool{
+		"small": {Subnet: "10.0.0.0/29", GatewayRule: GatewayRuleFirst, ReleaseCooldown: 300},
+	})
+	ctx := context.Background()
+	bm := newBitmap(8)
+	for _, offset := range []uint32{3, 4, 5, 6} {
+		bm.set(offset)
+	}
+	m.bitmaps["small"] = bm.encode()
+	allocation := &Allocation{Ip: "10.0.0.2/29", ContainerId: "c1", AllocatedAt: time.Now().Add(-time.Hour)}
+	if err := m.SaveAllocation(ctx, "small", allocation); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := IpAllocate(ctx, "small", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Release Cooldown") {
+		t.Fatalf("expected cooldown error, got %v", err)
+	}
+
+	releasedAt := time.Now().Add(-10 * time.Minute)
+	allocation.ReleasedAt = &releasedAt
+	if err := m.SaveAllocation(ctx, "small", allocation); err != nil {
+		t.Fatal(err)
+	}
+	ip, _, err := IpAllocate(ctx, "small", nil, nil)
+	if err != nil || ip != "10.0.0.2/29" {
+		t.Fatalf("got %s, %v, want 10.0.0.2/29", ip, err)
+	}
+}
@@ -0,0 +1,220 @@
+package netallocate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"util/etcdclient"
+	"util/log"
+)
+
+// 旧版本的地址池存放在/registry/<ipgroup>/iprange, 内容为逗号分隔的空闲IP列表, 格式为1.1.1.1/23
+// 分配时从列表中删除, 列表之外的地址都可能被运行中的Pod占用
+// 升级后需要先转换为pool和bitmap, 转换前etcd后端拒绝从该地址池分配
+
+// 地址池仍是旧版本的iprange格式时返回
+type LegacyPoolError struct {
+	IpGroup string
+}
+
+func (e *LegacyPoolError) Error() string {
+	return fmt.Sprintf("Pool: %s Still Uses Legacy %s, Convert It With etcdmigrate Before Allocating", e.IpGroup, legacyIpRangeKey(e.IpGroup))
+}
+
+func legacyIpRangeKey(ipGroup string) string {
+	return apiserverEtcdPrefix + "/" + ipGroup + "/iprange"
+}
+
+// pool或bitmap不存在时调用, 旧版本的iprange仍存在时返回*LegacyPoolError
+func legacyPoolCheck(ctx context.Context, ipGroup string) error {
+	_, err := etcdclient.Etcdclient.Get(ctx, legacyIpRangeKey(ipGroup))
+	if etcdclient.IsKeyNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Errorf("地址池: %s 仍是旧版本的iprange格式, 需要先转换", ipGroup)
+	return &LegacyPoolError{IpGroup: ipGroup}
+}
+
+// 转换时为旧版本Pod占用的IP写入的占位分配记录的containerid, 旧版本没有记录占用者
+// GC按IP核对运行中的Pod, 没有Pod使用时归还
+const LegacyContainerId = "legacy"
+
+// 转换结果
+type LegacyConversion struct {
+	IpGroup string
+	Subnet  string
+	// 旧列表中的空闲IP数量
+	Free int
+	// 不在旧列表中, 标记为已分配的可分配IP数量
+	Allocated int
+	// 为已分配的IP新写入的占位分配记录数量
+	Placeholders int
+	// bitmap已存在, 已经转换过
+	Skipped bool
+}
+
+// 根据旧版本的iprange生成pool和bitmap, 不在空闲列表中的地址全部标记为已分配
+// pool已存在(手工写入)时使用已有定义, 否则以template为基础, template未指定subnet时取空闲列表中IP所在的网段
+// 旧iprange不存在时返回ErrNotFound; pool、bitmap和旧iprange在同一个事务中校验版本后写入, 期间旧插件修改了iprange时返回错误
+// deleteOld为true时在同一事务中删除旧iprange
+func ConvertLegacyPool(ctx context.Context, ipGroup string, template *Pool, deleteOld, dryRun bool) (*LegacyConversion, error) {
+	b, ok := backend.(*etcdBackend)
+	if !ok {
+		return nil, fmt.Errorf("Convert Legacy Pool Failed, ErrorInfo: Backend Is Not Etcd")
+	}
+	if err := ValidateLegacyGroupName(ipGroup); err != nil {
+		return nil, err
+	}
+
+	legacyKey := legacyIpRangeKey(ipGroup)
+	ipRange, legacyRevision, err := etcdclient.Etcdclient.GetWithRevision(ctx, legacyKey)
+	if etcdclient.IsKeyNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	conversion := &LegacyConversion{IpGroup: ipGroup}
+
+	bitmapKey := b.groupKey(ipGroup, "bitmap")
+	if _, _, err = etcdclient.Etcdclient.GetWithRevision(ctx, bitmapKey); err == nil {
+		log.Infof("地址池: %s 的bitmap已存在, 跳过转换", ipGroup)
+		conversion.Skipped = true
+		return conversion, nil
+	} else if !etcdclient.IsKeyNotFound(err) {
+		return nil, err
+	}
+
+	var free []net.IP
+	var freeNets []*net.IPNet
+	for _, val := range strings.Split(ipRange, ",") {
+		if val = strings.TrimSpace(val); val == "" {
+			continue
+		}
+		ip, ipNet, err := net.ParseCIDR(val)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("Invalid Entry: %q In %s", val, legacyKey)
+		}
+		free = append(free, ip)
+		freeNets = append(freeNets, ipNet)
+	}
+
+	poolKey := b.groupKey(ipGroup, "pool")
+	pool := &Pool{}
+	poolRevision, err := b.getJson(ctx, poolKey, pool)
+	if err == ErrNotFound {
+		if template == nil {
+			template = &Pool{}
+		}
+		*pool = *template
+		if pool.Subnet == "" {
+			if pool.Subnet, err = legacySubnet(freeNets); err != nil {
+				return nil, fmt.Errorf("Convert Legacy Pool: %s Failed, ErrorInfo: %s", ipGroup, err.Error())
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err = pool.Parse(); err != nil {
+		return nil, fmt.Errorf("Invalid Pool: %s, ErrorInfo: %s", ipGroup, err.Error())
+	}
+	conversion.Subnet = pool.Subnet
+
+	bm := newBitmap(pool.size)
+	for offset := uint32(0); offset < pool.size; offset++ {
+		bm.set(offset)
+	}
+	for _, ip := range free {
+		offset, ok := pool.offsetOf(ip)
+		if !ok {
+			return nil, fmt.Errorf("Free IP: %s In %s Not In Subnet: %s", ip.String(), legacyKey, pool.Subnet)
+		}
+		if bm.test(offset) {
+			bm.clear(offset)
+			conversion.Free++
+		}
+	}
+	var allocated []string
+	for offset := uint32(0); offset < pool.size; offset++ {
+		if pool.allowed(offset) && bm.test(offset) {
+			allocated = append(allocated, pool.cidrOf(pool.base+offset))
+		}
+	}
+	conversion.Allocated = len(allocated)
+	if dryRun {
+		return conversion, nil
+	}
+
+	// 占位记录数量可能超过单个事务的操作数上限, 在转换前写入; 转换完成前地址池拒绝分配, 不会与ADD冲突
+	// 转换失败后重新执行时跳过已有记录, 之后变为空闲的IP留下的占位记录由GC归还
+	if conversion.Placeholders, err = saveLegacyPlaceholders(ctx, b, ipGroup, allocated); err != nil {
+		return nil, err
+	}
+
+	conds := map[string]int64{legacyKey: legacyRevision, bitmapKey: 0, poolKey: poolRevision}
+	puts := map[string]string{bitmapKey: bm.encode()}
+	if poolRevision == 0 {
+		data, err := json.Marshal(pool)
+		if err != nil {
+			return nil, fmt.Errorf("Marshal Pool: %s Failed, ErrorInfo: %s", ipGroup, err.Error())
+		}
+		puts[poolKey] = string(data)
+	}
+	var deletes []string
+	if deleteOld {
+		deletes = append(deletes, legacyKey)
+	}
+	swapped, err := etcdclient.Etcdclient.CompareAndSwapAll(ctx, conds, puts, deletes)
+	if err != nil {
+		return nil, err
+	}
+	if !swapped {
+		return nil, fmt.Errorf("Convert Legacy Pool: %s Failed, ErrorInfo: %s, Pool Or Bitmap Modified During Conversion, Stop The Old Plugin And Retry", ipGroup, legacyKey)
+	}
+	log.Infof("地址池: %s 已从旧版本iprange转换, 子网: %s, 空闲: %d, 标记为已分配: %d, 占位记录: %d", ipGroup, pool.Subnet, conversion.Free, conversion.Allocated, conversion.Placeholders)
+	return conversion, nil
+}
+
+// 为没有分配记录的已分配IP写入占位记录, 返回写入的数量
+func saveLegacyPlaceholders(ctx context.Context, b *etcdBackend, ipGroup string, ips []string) (int, error) {
+	existing, err := b.ListAllocations(ctx, ipGroup)
+	if err != nil {
+		return 0, err
+	}
+	recorded := make(map[string]bool, len(existing))
+	for _, a := range existing {
+		recorded[a.Ip] = true
+	}
+	now := time.Now()
+	saved := 0
+	for _, ip := range ips {
+		if recorded[ip] {
+			continue
+		}
+		if err := b.SaveAllocation(ctx, ipGroup, &Allocation{Ip: ip, ContainerId: LegacyContainerId, AllocatedAt: now}); err != nil {
+			return saved, fmt.Errorf("Save Placeholder Allocation Of IP: %s Failed, ErrorInfo: %s", ip, err.Error())
+		}
+		saved++
+	}
+	return saved, nil
+}
+
+// 旧列表中的IP都带掩码, 必须属于同一个网段
+func legacySubnet(nets []*net.IPNet) (string, error) {
+	if len(nets) == 0 {
+		return "", fmt.Errorf("legacy iprange is empty, subnet must be given")
+	}
+	subnet := nets[0].String()
+	for _, ipNet := range nets[1:] {
+		if ipNet.String() != subnet {
+			return "", fmt.Errorf("legacy iprange contains different subnets: %s and %s, subnet must be given", subnet, ipNet.String())
+		}
+	}
+	return subnet, nil
+}
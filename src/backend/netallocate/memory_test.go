@@ -0,0 +1,225 @@
+package netallocate
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的内存后端, 位图以版本号做与etcd相同的CAS校验
+type memBackend struct {
+	mu          sync.Mutex
+	pools       map[string]*Pool
+	bitmaps     map[string]string
+	versions    map[string]int
+	vlanMap     map[string]int
+	allocations map[string]map[string]*Allocation
+	history     map[string][]*Allocation
+	sticky      map[string]map[string]*StickyReservation
+	attachments map[string]*Attachment
+	// SwapBitmap因版本不一致失败的次数
+	conflicts int
+	// 读取位图后等待的时间, 让并发的读改写交错
+	readDelay time.Duration
+	// 不为nil时SwapBitmap返回该错误, 模拟事务超时; swapLost为false时写入已生效
+	swapErr  error
+	swapLost bool
+}
+
+// 替换包级后端, 测试结束后恢复
+func useMemBackend(t *testing.T, pools map[string]*Pool) *memBackend {
+	m := &memBackend{
+		pools:       pools,
+		bitmaps:     make(map[string]string),
+		versions:    make(map[string]int),
+		vlanMap:     make(map[string]int),
+		allocations: make(map[string]map[string]*Allocation),
+		history:     make(map[string][]*Allocation),
+		sticky:      make(map[string]map[string]*StickyReservation),
+		attachments: make(map[string]*Attachment),
+	}
+	prev := backend
+	backend = m
+	t.Cleanup(func() { backend = prev })
+	return m
+}
+
+func (m *memBackend) GetPool(ctx context.Context, ipGroup string) (*Pool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pools[ipGroup]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *p
+	return &copied, nil
+}
+
+func (m *memBackend) ListGroups(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var groups []string
+	for g := range m.pools {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (m *memBackend) GetBitmap(ctx context.Context, ipGroup string) (string, string, error) {
+	m.mu.Lock()
+	data, version := m.bitmaps[ipGroup], strconv.Itoa(m.versions[ipGroup])
+	m.mu.Unlock()
+	time.Sleep(m.readDelay)
+	return data, version, nil
+}
+
+func (m *memBackend) SwapBitmap(ctx context.Context, ipGroup, data, version string, claim *Allocation) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strconv.Itoa(m.versions[ipGroup]) != version {
+		m.conflicts++
+		return false, nil
+	}
+	if m.swapErr != nil && m.swapLost {
+		return false, m.swapErr
+	}
+	m.bitmaps[ipGroup] = data
+	m.versions[ipGroup]++
+	if claim != nil {
+		if m.allocations[ipGroup] == nil {
+			m.allocations[ipGroup] = make(map[string]*Allocation)
+		}
+		copied := *claim
+		m.allocations[ipGroup][claim.Ip] = &copied
+	}
+	if m.swapErr != nil {
+		return false, m.swapErr
+	}
+	return true, nil
+}
+
+func (m *memBackend) GetVlanMap(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw := make(map[string]int)
+	for k, v := range m.vlanMap {
+		raw[k] = v
+	}
+	return raw, nil
+}
+
+func (m *memBackend) SaveAllocation(ctx context.Context, ipGroup string, a *Allocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.allocations[ipGroup] == nil {
+		m.allocations[ipGroup] = make(map[string]*Allocation)
+	}
+	copied := *a
+	m.allocations[ipGroup][a.Ip] = &copied
+	return nil
+}
+
+func (m *memBackend) GetAllocation(ctx context.Context, ipGroup, ip string) (*Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.allocations[ipGroup][ip]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *a
+	return &copied, nil
+}
+
+func (m *memBackend) ListAllocations(ctx context.Context, ipGroup string) ([]*Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var allocations []*Allocation
+	for _, a := range m.allocations[ipGroup] {
+		copied := *a
+		allocations = append(allocations, &copied)
+	}
+	return allocations, nil
+}
+
+func (m *memBackend) SaveHistory(ctx context.Context, ipGroup string, a *Allocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ipGroup + "/" + a.Ip
+	copied := *a
+	m.history[key] = append(m.history[key], &copied)
+	return nil
+}
+
+func (m *memBackend) ListHistory(ctx context.Context, ipGroup, ip string) ([]*Allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Allocation(nil), m.history[ipGroup+"/"+ip]...), nil
+}
+
+func (m *memBackend) SaveSticky(ctx context.Context, ipGroup string, r *StickyReservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sticky[ipGroup] == nil {
+		m.sticky[ipGroup] = make(map[string]*StickyReservation)
+	}
+	copied := *r
+	m.sticky[ipGroup][r.PodNamespace+"/"+r.PodName] = &copied
+	return nil
+}
+
+func (m *memBackend) ListSticky(ctx context.Context, ipGroup string) ([]*StickyReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reservations []*StickyReservation
+	for _, r := range m.sticky[ipGroup] {
+		copied := *r
+		reservations = append(reservations, &copied)
+	}
+	return reservations, nil
+}
+
+func (m *memBackend) TakeSticky(ctx context.Context, ipGroup, podNamespace, podName string) (*StickyReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := podNamespace + "/" + podName
+	r, ok := m.sticky[ipGroup][key]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.sticky[ipGroup], key)
+	return r, nil
+}
+
+func attachmentKey(containerId, ifName string) string {
+	return containerId + "/" + ifName
+}
+
+func (m *memBackend) SaveAttachment(ctx context.Context, a *Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *a
+	m.attachments[attachmentKey(a.ContainerId, a.IfName)] = &copied
+	return nil
+}
+
+func (m *memBackend) GetAttachment(ctx context.Context, containerId, ifName string) (*Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attachments[attachmentKey(containerId, ifName)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *a
+	return &copied, nil
+}
+
+func (m *memBackend) DelAttachment(ctx context.Context, containerId, ifName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attachments, attachmentKey(containerId, ifName))
+	return nil
+}
@@ -0,0 +1,175 @@
+package netallocate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"util/etcdclient"
+	"util/log"
+)
+
+// 迁移结果统计
+type MigrateResult struct {
+	Copied   int
+	Skipped  int
+	Conflict int
+	Deleted  int
+	// 由旧版本iprange转换生成pool和bitmap的地址池数量
+	Converted int
+}
+
+// kube-apiserver在/registry下使用的资源名称, 与之同名的ipgroup在旧布局下会与apiserver的数据重叠, 拒绝迁移
+// 包括内置资源以及apiserver内部使用的key, 如replicationcontrollers对应controllers, nodes对应minions
+var apiserverResources = map[string]bool{
+	"apiextensions": true, "apiregistration": true, "certificatesigningrequests": true, "clusterrolebindings": true,
+	"clusterroles": true, "configmaps": true, "controllerrevisions": true, "controllers": true, "cronjobs": true,
+	"csidrivers": true, "csinodes": true, "csistoragecapacities": true, "daemonsets": true, "deployments": true,
+	"endpointslices": true, "events": true, "flowschemas": true, "horizontalpodautoscalers": true, "ingress": true,
+	"ingressclasses": true, "jobs": true, "leases": true, "limitranges": true, "masterleases": true, "minions": true,
+	"mutatingwebhookconfigurations": true, "namespaces": true, "networkpolicies": true, "persistentvolumeclaims": true,
+	"persistentvolumes": true, "poddisruptionbudgets": true, "pods": true, "podsecuritypolicy": true, "podtemplates": true,
+	"priorityclasses": true, "prioritylevelconfigurations": true, "ranges": true, "replicasets": true, "resourcequotas": true,
+	"rolebindings": true, "roles": true, "runtimeclasses": true, "secrets": true, "serviceaccounts": true, "services": true,
+	"statefulsets": true, "storageclasses": true, "validatingwebhookconfigurations": true, "volumeattachments": true,
+	// 旧布局中本插件自己使用的key
+	"vlanmap": true, "attachments": true,
+}
+
+// 旧布局下ipgroup直接位于/registry下, 除DNS label规则外不能与apiserver的资源或旧布局的其他key同名
+func ValidateLegacyGroupName(ipGroup string) error {
+	if err := ValidateGroupName(ipGroup); err != nil {
+		return err
+	}
+	if apiserverResources[ipGroup] {
+		return fmt.Errorf("invalid legacy ipgroup name: %q, %s/%s is used by kube-apiserver", ipGroup, apiserverEtcdPrefix, ipGroup)
+	}
+	return nil
+}
+
+// 将/registry下旧布局的数据迁移到当前etcd前缀下, 只迁移显式列出的key, 不按ipgroup前缀遍历:
+// vlanmap、attachments/以及groups中各ipgroup的pool、bitmap、allocations/、sticky/
+// 目标key已存在且内容相同时跳过, 内容不同时记为冲突并保留旧key
+// 旧版本的iprange不直接复制, 而是通过ConvertLegacyPool以template为基础转换为pool和bitmap
+// deleteOld为true时删除已迁移的旧key, dryRun为true时只统计不写入
+func MigrateLegacyKeys(ctx context.Context, groups []string, template *Pool, deleteOld, dryRun bool) (*MigrateResult, error) {
+	b, ok := backend.(*etcdBackend)
+	if !ok {
+		return nil, fmt.Errorf("Migrate Legacy Keys Failed, ErrorInfo: Backend Is Not Etcd")
+	}
+	for _, ipGroup := range groups {
+		if err := ValidateLegacyGroupName(ipGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	type mapping struct {
+		from, to string
+		prefix   bool
+	}
+	mappings := []mapping{
+		{from: apiserverEtcdPrefix + "/vlanmap", to: b.vlanMapKey()},
+		{from: apiserverEtcdPrefix + "/attachments/", to: b.prefix + "/attachments/", prefix: true},
+	}
+	for _, ipGroup := range groups {
+		legacyGroup := apiserverEtcdPrefix + "/" + ipGroup + "/"
+		mappings = append(mappings,
+			mapping{from: legacyGroup + "pool", to: b.groupKey(ipGroup, "pool")},
+			mapping{from: legacyGroup + "bitmap", to: b.groupKey(ipGroup, "bitmap")},
+			mapping{from: legacyGroup + "allocations/", to: b.groupKey(ipGroup, "allocations/"), prefix: true},
+			mapping{from: legacyGroup + "sticky/", to: b.groupKey(ipGroup, "sticky/"), prefix: true},
+		)
+	}
+
+	result := &MigrateResult{}
+	for _, m := range mappings {
+		kvs, err := legacyKvs(ctx, m.from, m.prefix)
+		if err != nil {
+			return result, err
+		}
+		for _, kv := range kvs {
+			newKey := m.to + strings.TrimPrefix(kv.Key, m.from)
+			if err := migrateKey(ctx, kv.Key, newKey, kv.Value, kv.ModRevision, deleteOld, dryRun, result); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	for _, ipGroup := range groups {
+		conversion, err := ConvertLegacyPool(ctx, ipGroup, template, deleteOld, dryRun)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if conversion.Skipped {
+			log.Warnf("地址池: %s 已存在bitmap, 旧版本iprange未转换也未删除", ipGroup)
+			result.Conflict++
+			continue
+		}
+		log.Infof("地址池: %s 转换完成, 子网: %s, 空闲IP: %d, 标记为已分配: %d, 占位记录: %d", ipGroup, conversion.Subnet, conversion.Free, conversion.Allocated, conversion.Placeholders)
+		result.Converted++
+	}
+	return result, nil
+}
+
+func migrateKey(ctx context.Context, oldKey, newKey, value string, modRevision int64, deleteOld, dryRun bool, result *MigrateResult) error {
+	current, _, err := etcdclient.Etcdclient.GetWithRevision(ctx, newKey)
+	switch {
+	case etcdclient.IsKeyNotFound(err):
+		if !dryRun {
+			// 以ModRevision为0写入, 迁移期间插件已写入新key时不覆盖
+			written, err := etcdclient.Etcdclient.CompareAndSwap(ctx, newKey, value, 0)
+			if err != nil {
+				return err
+			}
+			if !written {
+				log.Warnf("迁移key: %s 时目标key: %s 已被写入, 保留旧key", oldKey, newKey)
+				result.Conflict++
+				return nil
+			}
+		}
+		log.Infof("迁移key: %s -> %s", oldKey, newKey)
+		result.Copied++
+	case err != nil:
+		return err
+	case current == value:
+		result.Skipped++
+	default:
+		log.Warnf("目标key: %s 已存在且内容与旧key: %s 不同, 保留旧key", newKey, oldKey)
+		result.Conflict++
+		return nil
+	}
+
+	if !deleteOld {
+		return nil
+	}
+	if !dryRun {
+		// 旧key在迁移期间被修改时不删除
+		deleted, err := etcdclient.Etcdclient.CompareAndDelete(ctx, oldKey, modRevision)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			log.Warnf("旧key: %s 在迁移期间被修改, 未删除", oldKey)
+			return nil
+		}
+	}
+	result.Deleted++
+	return nil
+}
+
+// 读取旧布局下的key, prefix为false时精确读取
+func legacyKvs(ctx context.Context, key string, prefix bool) ([]etcdclient.KeyValue, error) {
+	if prefix {
+		return etcdclient.Etcdclient.List(ctx, key)
+	}
+	value, modRevision, err := etcdclient.Etcdclient.GetWithRevision(ctx, key)
+	if etcdclient.IsKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []etcdclient.KeyValue{{Key: key, Value: value, ModRevision: modRevision}}, nil
+}
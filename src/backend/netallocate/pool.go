@@ -0,0 +1,263 @@
+package netallocate
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"net"
+	"strings"
+	"util/log"
+)
+
+// 地址池最大支持/16, 位图最大8KB
+const minPoolPrefix = 16
+
+// 网关规则, 取子网第一个或最后一个可用地址作为网关
+const (
+	GatewayRuleFirst = "first"
+	GatewayRuleLast  = "last"
+)
+
+// 分配策略, first取第一个空闲地址, lru取最久之前归还的空闲地址
+const (
+	StrategyFirst = "first"
+	StrategyLru   = "lru"
+)
+
+// 地址池定义, etcd后端存放在<prefix>/groups/<ipgroup>/pool, CRD后端为IPPool对象的spec
+// Gateway与GatewayRule二选一, Include为空时表示整个子网可分配
+// Include/Exclude支持单个IP、a.b.c.d-e.f.g.h以及CIDR格式
+type Pool struct {
+	Subnet      string   `json:"subnet"`
+	Gateway     string   `json:"gateway,omitempty"`
+	GatewayRule string   `json:"gatewayRule,omitempty"`
+	VlanId      int      `json:"vlanId"`
+	Include     []string `json:"include,omitempty"`
+	Exclude     []string `json:"exclude,omitempty"`
+	Reserved    []string `json:"reserved,omitempty"`
+	// 开启后Pod删除时IP为同名Pod保留StickyGracePeriod秒
+	Sticky            bool `json:"sticky,omitempty"`
+	StickyGracePeriod int  `json:"stickyGracePeriod,omitempty"`
+	// IP归还后ReleaseCooldown秒内不再分配, 避免上游路由器和其他Pod缓存的ARP把流量发给新Pod
+	ReleaseCooldown int    `json:"releaseCooldown,omitempty"`
+	Strategy        string `json:"strategy,omitempty"`
+	// 允许从地址池分配IP的namespace, 两者都为空时不限制
+	Namespaces        []string              `json:"namespaces,omitempty"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// 以下字段由Parse根据配置计算得出
+	ipNet      *net.IPNet
+	base       uint32
+	size       uint32
+	gateway    uint32
+	include    []ipSpan
+	exclude    []ipSpan
+	nsSelector labels.Selector
+}
+
+// 闭区间[start, end]
+type ipSpan struct {
+	start uint32
+	end   uint32
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIp(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// ipgroup名称需要符合DNS label规则, 同时作为etcd key的一段以及IPPool对象的名称
+func ValidateGroupName(ipGroup string) error {
+	if errs := validation.IsDNS1123Label(ipGroup); len(errs) > 0 {
+		return fmt.Errorf("invalid ipgroup name: %q, %s", ipGroup, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func GetPool(ctx context.Context, ipGroup string) (*Pool, error) {
+	if err := ValidateGroupName(ipGroup); err != nil {
+		return nil, err
+	}
+	p, err := backend.GetPool(ctx, ipGroup)
+	if err != nil {
+		log.Errorf("获取地址池: %s 定义失败, 错误信息: %s", ipGroup, err.Error())
+		return nil, err
+	}
+	if err := p.Parse(); err != nil {
+		return nil, fmt.Errorf("Invalid Pool: %s, ErrorInfo: %s", ipGroup, err.Error())
+	}
+	return p, nil
+}
+
+// 校验地址池配置并计算可分配范围
+func (p *Pool) Parse() error {
+	_, ipNet, err := net.ParseCIDR(p.Subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return fmt.Errorf("invalid ipv4 subnet: %s", p.Subnet)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ones < minPoolPrefix || ones > 30 {
+		return fmt.Errorf("subnet prefix length must be between %d and 30, got: %s", minPoolPrefix, p.Subnet)
+	}
+	p.ipNet = ipNet
+	p.base = ipToUint32(ipNet.IP)
+	p.size = 1 << uint(bits-ones)
+
+	if p.StickyGracePeriod < 0 {
+		return fmt.Errorf("invalid stickyGracePeriod: %d", p.StickyGracePeriod)
+	}
+	if p.ReleaseCooldown < 0 {
+		return fmt.Errorf("invalid releaseCooldown: %d", p.ReleaseCooldown)
+	}
+	if p.Strategy != "" && p.Strategy != StrategyFirst && p.Strategy != StrategyLru {
+		return fmt.Errorf("invalid strategy: %s, must be %s or %s", p.Strategy, StrategyFirst, StrategyLru)
+	}
+	if p.VlanId != 0 && (p.VlanId < minVlanId || p.VlanId > maxVlanId) {
+		return fmt.Errorf("invalid vlanId: %d, must be between %d and %d", p.VlanId, minVlanId, maxVlanId)
+	}
+
+	for _, ns := range p.Namespaces {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace: %q, %s", ns, strings.Join(errs, "; "))
+		}
+	}
+	if p.NamespaceSelector != nil {
+		if p.nsSelector, err = metav1.LabelSelectorAsSelector(p.NamespaceSelector); err != nil {
+			return fmt.Errorf("invalid namespaceSelector: %s", err.Error())
+		}
+	}
+
+	if p.gateway, err = p.parseGateway(); err != nil {
+		return err
+	}
+
+	if p.include, err = p.parseSpans(p.Include); err != nil {
+		return err
+	}
+	if p.exclude, err = p.parseSpans(p.Exclude); err != nil {
+		return err
+	}
+	reserved, err := p.parseSpans(p.Reserved)
+	if err != nil {
+		return err
+	}
+	p.exclude = append(p.exclude, reserved...)
+	return nil
+}
+
+// 根据Gateway或GatewayRule计算网关, 网关必须是子网内的可用主机地址
+func (p *Pool) parseGateway() (uint32, error) {
+	switch {
+	case p.Gateway != "" && p.GatewayRule != "":
+		return 0, fmt.Errorf("gateway and gatewayRule can not be set together")
+	case p.Gateway != "":
+		gw := net.ParseIP(p.Gateway)
+		if gw == nil || gw.To4() == nil || !p.ipNet.Contains(gw) {
+			return 0, fmt.Errorf("gateway: %s not in subnet: %s", p.Gateway, p.Subnet)
+		}
+		n := ipToUint32(gw)
+		if n == p.base || n == p.base+p.size-1 {
+			return 0, fmt.Errorf("gateway: %s is network or broadcast address of subnet: %s", p.Gateway, p.Subnet)
+		}
+		return n, nil
+	case p.GatewayRule == GatewayRuleFirst:
+		return p.base + 1, nil
+	case p.GatewayRule == GatewayRuleLast:
+		return p.base + p.size - 2, nil
+	case p.GatewayRule == "":
+		return 0, fmt.Errorf("gateway or gatewayRule must be set")
+	default:
+		return 0, fmt.Errorf("invalid gatewayRule: %s, must be %s or %s", p.GatewayRule, GatewayRuleFirst, GatewayRuleLast)
+	}
+}
+
+func (p *Pool) parseSpans(entries []string) ([]ipSpan, error) {
+	var spans []ipSpan
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		var span ipSpan
+		switch {
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil || ipNet.IP.To4() == nil {
+				return nil, fmt.Errorf("invalid cidr: %s", entry)
+			}
+			ones, bits := ipNet.Mask.Size()
+			span.start = ipToUint32(ipNet.IP)
+			span.end = span.start + (1 << uint(bits-ones)) - 1
+		case strings.Contains(entry, "-"):
+			pair := strings.SplitN(entry, "-", 2)
+			start, end := net.ParseIP(strings.TrimSpace(pair[0])), net.ParseIP(strings.TrimSpace(pair[1]))
+			if start == nil || end == nil || start.To4() == nil || end.To4() == nil {
+				return nil, fmt.Errorf("invalid ip range: %s", entry)
+			}
+			span.start, span.end = ipToUint32(start), ipToUint32(end)
+			if span.start > span.end {
+				return nil, fmt.Errorf("invalid ip range: %s, start after end", entry)
+			}
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid ip: %s", entry)
+			}
+			span.start = ipToUint32(ip)
+			span.end = span.start
+		}
+		if span.start < p.base || span.end > p.base+p.size-1 {
+			return nil, fmt.Errorf("%s not in subnet: %s", entry, p.Subnet)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+// 判断子网内第offset个地址是否允许分配, 网络地址、广播地址和网关自动排除
+func (p *Pool) allowed(offset uint32) bool {
+	if offset == 0 || offset >= p.size-1 {
+		return false
+	}
+	n := p.base + offset
+	if n == p.gateway {
+		return false
+	}
+	if len(p.include) > 0 && !inSpans(p.include, n) {
+		return false
+	}
+	return !inSpans(p.exclude, n)
+}
+
+func inSpans(spans []ipSpan, n uint32) bool {
+	for _, span := range spans {
+		if n >= span.start && n <= span.end {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回IP在子网中的偏移, 不在子网内时返回false
+func (p *Pool) offsetOf(ip net.IP) (uint32, bool) {
+	if ip == nil || ip.To4() == nil || !p.ipNet.Contains(ip) {
+		return 0, false
+	}
+	return ipToUint32(ip) - p.base, true
+}
+
+// 返回网关地址, 格式为1.1.1.1/23
+func (p *Pool) GatewayCidr() string {
+	return p.cidrOf(p.gateway)
+}
+
+// 返回带掩码的地址, 格式为1.1.1.1/23
+func (p *Pool) cidrOf(n uint32) string {
+	ones, _ := p.ipNet.Mask.Size()
+	return fmt.Sprintf("%s/%d", uint32ToIp(n).String(), ones)
+}
@@ -0,0 +1,129 @@
+package netallocate
+
+import (
+	"testing"
+)
+
+func TestPoolParseGateway(t *testing.T) {
+	cases := []struct {
+		name    string
+		pool    Pool
+		gateway string
+		wantErr bool
+	}{
+		{name: "rule first", pool: Pool{Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst}, gateway: "10.0.0.1/24"},
+		{name: "rule last", pool: Pool{Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleLast}, gateway: "10.0.0.254/24"},
+		{name: "rule last /23", pool: Pool{Subnet: "10.0.2.0/23", GatewayRule: GatewayRuleLast}, gateway: "10.0.3.254/23"},
+		{name: "explicit gateway", pool: Pool{Subnet: "10.0.0.0/24", Gateway: "10.0.0.100"}, gateway: "10.0.0.100/24"},
+		{name: "gateway outside subnet", pool: Pool{Subnet: "10.0.0.0/24", Gateway: "10.0.1.1"}, wantErr: true},
+		{name: "gateway is network address", pool: Pool{Subnet: "10.0.0.0/24", Gateway: "10.0.0.0"}, wantErr: true},
+		{name: "gateway is broadcast address", pool: Pool{Subnet: "10.0.0.0/24", Gateway: "10.0.0.255"}, wantErr: true},
+		{name: "gateway and rule together", pool: Pool{Subnet: "10.0.0.0/24", Gateway: "10.0.0.1", GatewayRule: GatewayRuleFirst}, wantErr: true},
+		{name: "no gateway", pool: Pool{Subnet: "10.0.0.0/24"}, wantErr: true},
+		{name: "invalid rule", pool: Pool{Subnet: "10.0.0.0/24", GatewayRule: "middle"}, wantErr: true},
+		{name: "prefix too short", pool: Pool{Subnet: "10.0.0.0/15", GatewayRule: GatewayRuleFirst}, wantErr: true},
+		{name: "prefix too long", pool: Pool{Subnet: "10.0.0.0/31", GatewayRule: GatewayRuleFirst}, wantErr: true},
+		{name: "ipv6 subnet", pool: Pool{Subnet: "fd00::/120", GatewayRule: GatewayRuleFirst}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := c.pool
+			err := p.Parse()
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got gateway %s", p.GatewayCidr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := p.GatewayCidr(); got != c.gateway {
+				t.Fatalf("gateway = %s, want %s", got, c.gateway)
+			}
+		})
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	p := &Pool{Subnet: "10.0.0.0/24", GatewayRule: GatewayRuleFirst}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	base := p.base
+	cases := []struct {
+		name    string
+		entries []string
+		want    []ipSpan
+		wantErr bool
+	}{
+		{name: "empty", entries: nil, want: nil},
+		{name: "single ip", entries: []string{"10.0.0.5"}, want: []ipSpan{{base + 5, base + 5}}},
+		{name: "range", entries: []string{"10.0.0.10-10.0.0.20"}, want: []ipSpan{{base + 10, base + 20}}},
+		{name: "range with spaces", entries: []string{" 10.0.0.10 - 10.0.0.20 "}, want: []ipSpan{{base + 10, base + 20}}},
+		{name: "cidr", entries: []string{"10.0.0.64/26"}, want: []ipSpan{{base + 64, base + 127}}},
+		{name: "multiple", entries: []string{"10.0.0.1", "10.0.0.128/25"}, want: []ipSpan{{base + 1, base + 1}, {base + 128, base + 255}}},
+		{name: "reversed range", entries: []string{"10.0.0.20-10.0.0.10"}, wantErr: true},
+		{name: "ip outside subnet", entries: []string{"10.0.1.1"}, wantErr: true},
+		{name: "range leaves subnet", entries: []string{"10.0.0.250-10.0.1.2"}, wantErr: true},
+		{name: "cidr larger than subnet", entries: []string{"10.0.0.0/23"}, wantErr: true},
+		{name: "invalid ip", entries: []string{"10.0.0.300"}, wantErr: true},
+		{name: "invalid cidr", entries: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			spans, err := p.parseSpans(c.entries)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", spans)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(spans) != len(c.want) {
+				t.Fatalf("spans = %v, want %v", spans, c.want)
+			}
+			for i := range spans {
+				if spans[i] != c.want[i] {
+					t.Fatalf("spans = %v, want %v", spans, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolAllowed(t *testing.T) {
+	p := &Pool{
+		Subnet:      "10.0.0.0/24",
+		GatewayRule: GatewayRuleLast,
+		Include:     []string{"10.0.0.0/25"},
+		Exclude:     []string{"10.0.0.10-10.0.0.19"},
+		Reserved:    []string{"10.0.0.100"},
+	}
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		offset uint32
+		want   bool
+	}{
+		{0, false},
+		{1, true},
+		{9, true},
+		{10, false},
+		{19, false},
+		{20, true},
+		{100, false},
+		{127, true},
+		{128, false},
+		{254, false},
+		{255, false},
+	}
+	for _, c := range cases {
+		if got := p.allowed(c.offset); got != c.want {
+			t.Errorf("allowed(%d) = %v, want %v", c.offset, got, c.want)
+		}
+	}
+}
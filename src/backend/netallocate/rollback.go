@@ -0,0 +1,38 @@
+package netallocate
+
+import (
+	"context"
+	"time"
+	"util/log"
+)
+
+type rollbackStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// 记录ADD已完成的步骤, 失败时按逆序撤销, multi-vlan-cni和etcdipam共用
+// Add可以直接作为Assign的UndoRecorder
+type Rollback struct {
+	steps []rollbackStep
+}
+
+func (r *Rollback) Add(name string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// 逆序执行撤销, 单步失败只记录日志, 继续撤销剩余步骤
+// cmd的ctx可能已经超时, 回滚使用独立的ctx
+func (r *Rollback) Run(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(ctx); err != nil {
+			log.Errorf("回滚步骤: %s 失败, 错误信息: %s", step.name, err.Error())
+			continue
+		}
+		log.Infof("回滚步骤: %s 完成", step.name)
+	}
+	r.steps = nil
+}
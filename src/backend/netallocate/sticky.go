@@ -0,0 +1,108 @@
+package netallocate
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+	"util/log"
+)
+
+// 地址池未配置保留时长时的默认值
+const defaultStickyGracePeriod = 3600
+
+// 固定IP的保留记录, etcd后端存放在<prefix>/groups/<ipgroup>/sticky/<namespace>/<podname>
+// CRD后端存放在IPPool对象的status.sticky中
+// 保留期间位图中的IP保持占用状态, 同名Pod在任意节点重建时取回该IP
+type StickyReservation struct {
+	Ip           string    `json:"ip"`
+	PodNamespace string    `json:"podNamespace"`
+	PodName      string    `json:"podName"`
+	ReleasedAt   time.Time `json:"releasedAt"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// 地址池开启sticky或Pod通过annotation开启时启用固定IP
+func StickyEnabled(ctx context.Context, ipGroup string, podOptIn bool) (bool, error) {
+	if podOptIn {
+		return true, nil
+	}
+	pool, err := GetPool(ctx, ipGroup)
+	if err != nil {
+		return false, err
+	}
+	return pool.Sticky, nil
+}
+
+// DEL时为Pod保留IP, 保留时长取地址池的stickyGracePeriod
+func ReserveSticky(ctx context.Context, ipGroup, podNamespace, podName, ip string) error {
+	pool, err := GetPool(ctx, ipGroup)
+	if err != nil {
+		return err
+	}
+	gracePeriod := pool.StickyGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultStickyGracePeriod
+	}
+	now := time.Now()
+	return saveSticky(ctx, ipGroup, &StickyReservation{
+		Ip:           ip,
+		PodNamespace: podNamespace,
+		PodName:      podName,
+		ReleasedAt:   now,
+		ExpiresAt:    now.Add(time.Duration(gracePeriod) * time.Second),
+	})
+}
+
+func saveSticky(ctx context.Context, ipGroup string, r *StickyReservation) error {
+	if err := backend.SaveSticky(ctx, ipGroup, r); err != nil {
+		return err
+	}
+	log.Infof("IP: %s 为Pod: %s/%s 保留至: %s", r.Ip, r.PodNamespace, r.PodName, r.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// ADD时取回Pod保留的IP以及网关, 没有可用的保留记录时返回nil
+// 保留已过期或IP不在ipRange中时归还该IP, 调用方按正常流程分配
+func ClaimSticky(ctx context.Context, ipGroup, podNamespace, podName string, ipRange []string) (*StickyReservation, string, error) {
+	// 取出同时删除保留记录, 避免并发的ADD重复使用同一个IP
+	r, err := backend.TakeSticky(ctx, ipGroup, podNamespace, podName)
+	if err != nil || r == nil {
+		return nil, "", err
+	}
+
+	if time.Now().After(r.ExpiresAt) || !inIpRange(r.Ip, ipRange) {
+		log.Infof("Pod: %s/%s 的保留IP: %s 已过期或不在ipv4列表中, 归还到地址池", podNamespace, podName, r.Ip)
+		if err := IpRelease(ctx, ipGroup, r.Ip); err != nil {
+			return nil, "", err
+		}
+		return nil, "", nil
+	}
+	pool, err := GetPool(ctx, ipGroup)
+	if err != nil {
+		if unclaimErr := UnclaimSticky(ctx, ipGroup, r); unclaimErr != nil {
+			log.Errorf("恢复Pod: %s/%s 的保留IP: %s 失败, 错误信息: %s", podNamespace, podName, r.Ip, unclaimErr.Error())
+		}
+		return nil, "", err
+	}
+	log.Infof("Pod: %s/%s 取回保留IP: %s", podNamespace, podName, r.Ip)
+	return r, pool.GatewayCidr(), nil
+}
+
+// 撤销取回操作, cmdAdd回滚时恢复保留记录
+func UnclaimSticky(ctx context.Context, ipGroup string, r *StickyReservation) error {
+	return saveSticky(ctx, ipGroup, r)
+}
+
+func inIpRange(ip string, ipRange []string) bool {
+	if len(ipRange) == 0 {
+		return true
+	}
+	addr := net.ParseIP(strings.Split(ip, "/")[0])
+	for _, val := range ipRange {
+		if net.ParseIP(strings.Split(strings.TrimSpace(val), "/")[0]).Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
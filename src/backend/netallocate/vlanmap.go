@@ -0,0 +1,74 @@
+package netallocate
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"util/log"
+)
+
+const (
+	minVlanId = 1
+	maxVlanId = 4094
+)
+
+// 子网到VLAN的映射表, etcd后端存放在<prefix>/vlanmap, CRD后端由各IPPool的subnet和vlanId组成
+// 格式为{"10.10.0.0/23": 2135, "10.10.0.0/16": 2100}, 按最长前缀匹配
+
+type vlanEntry struct {
+	ipNet  *net.IPNet
+	vlanId int
+}
+
+func GetVlanMap(ctx context.Context) ([]vlanEntry, error) {
+	raw, err := backend.GetVlanMap(ctx)
+	if err != nil {
+		log.Errorf("获取VLAN映射表失败, 错误信息: %s", err.Error())
+		return nil, err
+	}
+
+	var entries []vlanEntry
+	for subnet, vlanId := range raw {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, fmt.Errorf("Invalid Vlan Map Subnet: %s", subnet)
+		}
+		if vlanId < minVlanId || vlanId > maxVlanId {
+			return nil, fmt.Errorf("Invalid VlanId: %d Of Subnet: %s, Must Be Between %d And %d", vlanId, subnet, minVlanId, maxVlanId)
+		}
+		entries = append(entries, vlanEntry{ipNet: ipNet, vlanId: vlanId})
+	}
+	return entries, nil
+}
+
+// 最长前缀匹配, 没有匹配的子网时返回false
+func lookupVlan(entries []vlanEntry, ip net.IP) (int, bool) {
+	vlanId, longest := 0, -1
+	for _, entry := range entries {
+		if !entry.ipNet.Contains(ip) {
+			continue
+		}
+		if ones, _ := entry.ipNet.Mask.Size(); ones > longest {
+			vlanId, longest = entry.vlanId, ones
+		}
+	}
+	return vlanId, longest >= 0
+}
+
+// 只根据VLAN映射表获取IP所属VLAN, 不校验地址池, 供委托IPAM分配的地址使用
+func LookupVlan(ctx context.Context, ip string) (int, error) {
+	ipAddr, _, err := net.ParseCIDR(ip)
+	if err != nil {
+		return 0, fmt.Errorf("Reslov IP: %s Failed", ip)
+	}
+	entries, err := GetVlanMap(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vlanId, found := lookupVlan(entries, ipAddr)
+	if !found {
+		log.Errorf("IP: %s 在VLAN映射表中没有匹配的子网", ip)
+		return 0, fmt.Errorf("No Vlan Mapping For IP: %s", ip)
+	}
+	return vlanId, nil
+}
@@ -0,0 +1,46 @@
+package netallocate
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLookupVlan(t *testing.T) {
+	var entries []vlanEntry
+	for subnet, vlanId := range map[string]int{
+		"10.10.0.0/16":   2100,
+		"10.10.0.0/23":   2135,
+		"10.10.1.0/24":   2136,
+		"192.168.0.0/24": 10,
+	} {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, vlanEntry{ipNet: ipNet, vlanId: vlanId})
+	}
+
+	cases := []struct {
+		ip     string
+		vlanId int
+		found  bool
+	}{
+		{ip: "10.10.0.5", vlanId: 2135, found: true},
+		{ip: "10.10.1.5", vlanId: 2136, found: true},
+		{ip: "10.10.2.5", vlanId: 2100, found: true},
+		{ip: "10.10.255.255", vlanId: 2100, found: true},
+		{ip: "192.168.0.1", vlanId: 10, found: true},
+		{ip: "192.168.1.1", found: false},
+		{ip: "172.16.0.1", found: false},
+	}
+	for _, c := range cases {
+		vlanId, found := lookupVlan(entries, net.ParseIP(c.ip))
+		if found != c.found || vlanId != c.vlanId {
+			t.Errorf("lookupVlan(%s) = %d, %v, want %d, %v", c.ip, vlanId, found, c.vlanId, c.found)
+		}
+	}
+
+	if _, found := lookupVlan(nil, net.ParseIP("10.10.0.5")); found {
+		t.Error("lookupVlan with empty map should not match")
+	}
+}
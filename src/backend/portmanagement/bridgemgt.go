@@ -4,15 +4,20 @@ import (
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"net"
+	"util/log"
 )
 
 type Bridge struct {
 	Name string
+	MTU  int
+	// 是否由本次调用创建, 回滚时只删除自己创建的网桥
+	Created bool
 }
 
-func NewBridgeObject(bridgeName string) *Bridge {
+func NewBridgeObject(bridgeName string, mtu int) *Bridge {
 	return &Bridge{
 		Name: bridgeName,
+		MTU:  mtu,
 	}
 }
 
@@ -26,12 +31,26 @@ func JudgeExist(intName string) bool {
 	}
 }
 
+// 判断除exceptIndex外是否还有接口挂载在masterIndex上
+func hasOtherSlaves(masterIndex, exceptIndex int) (bool, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return false, fmt.Errorf("List Links Failed, ErrorInfo: %s", err.Error())
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex == masterIndex && link.Attrs().Index != exceptIndex {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (b *Bridge) Create() (*netlink.Bridge, error) {
 	if JudgeExist(b.Name) == false {
 		bridge := &netlink.Bridge{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:   b.Name,
-				MTU:    1500,
+				MTU:    b.MTU,
 				TxQLen: -1,
 			},
 		}
@@ -39,6 +58,7 @@ func (b *Bridge) Create() (*netlink.Bridge, error) {
 		if err := netlink.LinkAdd(bridge); err != nil {
 			return nil, fmt.Errorf("Create Bridge Interface: %s Failed, ErrorInfo: %s", b.Name, err.Error())
 		}
+		b.Created = true
 
 		//打开bridge接口
 		if err := netlink.LinkSetUp(bridge); err != nil {
@@ -46,14 +66,39 @@ func (b *Bridge) Create() (*netlink.Bridge, error) {
 		}
 		return bridge, nil
 	} else {
-		bridge := &netlink.Bridge{
-			LinkAttrs: netlink.LinkAttrs{
-				Name:   b.Name,
-				MTU:    1500,
-				TxQLen: -1,
-			},
+		// 已存在的网桥需要取回真实的index, 供vlan子接口挂载
+		link, err := netlink.LinkByName(b.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Get Bridge Interface: %s Failed, ErrorInfo: %s", b.Name, err.Error())
+		}
+		bridge, ok := link.(*netlink.Bridge)
+		if !ok {
+			return nil, fmt.Errorf("Interface: %s Is Not Bridge Type, Actual Type: %s", b.Name, link.Type())
 		}
 		return bridge, nil
 	}
 
 }
+
+// 删除网桥, 仍有接口挂载在网桥上时保留
+func (b *Bridge) Delete() error {
+	if JudgeExist(b.Name) == false {
+		return nil
+	}
+	link, err := netlink.LinkByName(b.Name)
+	if err != nil {
+		return fmt.Errorf("Get Bridge Interface: %s Failed, ErrorInfo: %s", b.Name, err.Error())
+	}
+	inUse, err := hasOtherSlaves(link.Attrs().Index, 0)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		log.Infof("网桥: %s 上仍有接口挂载, 跳过删除", b.Name)
+		return nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("Delete Bridge Interface: %s Failed, ErrorInfo: %s", b.Name, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package portmanagement
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// 同一节点上同一VLAN的Pod共用网桥和vlan子接口, 判断接口是否仍被使用与其他调用挂载veth必须互斥
+// 创建网桥、子接口到veth挂载完成, 以及回滚删除网桥、子接口时都需要持有该VLAN的锁
+const lockDir = "/run/multivlancni"
+
+// 锁等待期间的轮询间隔
+const lockPollInterval = 20 * time.Millisecond
+
+type VlanLock struct {
+	file *os.File
+}
+
+// 获取节点上该VLAN的文件锁, ctx结束前一直等待
+// 进程退出时内核自动释放, 不会因插件异常退出而死锁
+func LockVlan(ctx context.Context, vlanId int) (*VlanLock, error) {
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return nil, fmt.Errorf("Create Lock Dir: %s Failed, ErrorInfo: %s", lockDir, err.Error())
+	}
+	path := filepath.Join(lockDir, fmt.Sprintf("vlan-%d.lock", vlanId))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Open Lock File: %s Failed, ErrorInfo: %s", path, err.Error())
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &VlanLock{file: file}, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			file.Close()
+			return nil, fmt.Errorf("Lock File: %s Failed, ErrorInfo: %s", path, err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, fmt.Errorf("Lock Vlan: %d Failed, ErrorInfo: %s", vlanId, ctx.Err().Error())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// 关闭文件即释放锁
+func (l *VlanLock) Unlock() error {
+	return l.file.Close()
+}
@@ -2,11 +2,13 @@ package portmanagement
 
 import (
 	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 	"net"
+	"util/log"
 )
 
 type Veth struct {
@@ -15,14 +17,18 @@ type Veth struct {
 	NetNs           string
 	ContainerIp     string
 	ContainerGw     string
+	MTU             int
+	// 默认路由之外的路由, 未指定下一跳时经过ContainerGw
+	Routes []*types.Route
 }
 
-func NewVethObject(containerIfName, nsPath, containerIp, containerGw string) *Veth {
+func NewVethObject(containerIfName, nsPath, containerIp, containerGw string, mtu int) *Veth {
 	return &Veth{
 		ContainerIfName: containerIfName,
 		NetNs:           nsPath,
 		ContainerIp:     containerIp,
 		ContainerGw:     containerGw,
+		MTU:             mtu,
 	}
 }
 
@@ -31,14 +37,22 @@ func (e *Veth) Create() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Get NetNs Falied, Failed NetNs Path: %s", e.NetNs)
 	}
+	defer netns.Close()
 
 	// 创建veth并获取一堆接口对象的方法
-	var handler = func(hostNS ns.NetNS) error {
-		hostVeth, containerVeth, err := ip.SetupVeth(e.ContainerIfName, 1500, hostNS)
+	var handler = func(hostNS ns.NetNS) (err error) {
+		hostVeth, containerVeth, err := ip.SetupVeth(e.ContainerIfName, e.MTU, hostNS)
 		if err != nil {
 			return fmt.Errorf("Create Veth: %s Failed On NetNs: %s", e.ContainerIfName, e.NetNs)
 		}
 		e.HostIfName = hostVeth.Name
+		// 后续配置失败时删除已创建的veth pair, 避免残留半成品接口
+		defer func() {
+			if err != nil {
+				ip.DelLinkByName(containerVeth.Name)
+				e.HostIfName = ""
+			}
+		}()
 		// 解析container的接口IP
 		containerIp, containerNet, err := net.ParseCIDR(e.ContainerIp)
 		if err != nil {
@@ -60,6 +74,9 @@ func (e *Veth) Create() (string, error) {
 
 		// 配置container 网关&&路由
 		containerGwIp, containerGwNet, err := net.ParseCIDR(e.ContainerGw)
+		if err != nil {
+			return fmt.Errorf("Reslov Container Gateway: %s  Failed", e.ContainerGw)
+		}
 		containerGwNet.IP = containerGwIp
 		_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
 		defaultRoute := &netlink.Route{
@@ -71,20 +88,44 @@ func (e *Veth) Create() (string, error) {
 		if err != nil {
 			return fmt.Errorf("Add Container Default Route Failed")
 		}
+
+		for _, route := range e.Routes {
+			if isDefaultRoute(&route.Dst) {
+				continue
+			}
+			gw := route.GW
+			if gw == nil {
+				gw = containerGwNet.IP
+			}
+			dst := route.Dst
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: containerLink.Attrs().Index,
+				Gw:        gw,
+				Dst:       &dst,
+			})
+			if err != nil {
+				return fmt.Errorf("Add Container Route: %s Failed, ErrorInfo: %s", dst.String(), err.Error())
+			}
+		}
 		return nil
 	}
 
 	err = netns.Do(handler)
 	if err != nil {
-		return "", fmt.Errorf("Config Veth Pair Interface Failed")
+		return "", fmt.Errorf("Config Veth Pair Interface Failed, ErrorInfo: %s", err.Error())
 	}
-	defer netns.Close()
 	return e.HostIfName, nil
 }
 
 func (e *Veth) Attach(brName, configIp string) error {
-	hostLink, _ := netlink.LinkByName(e.HostIfName)
-	hostBridgeLink, _ := netlink.LinkByName(brName)
+	hostLink, err := netlink.LinkByName(e.HostIfName)
+	if err != nil {
+		return fmt.Errorf("Get Host Interface: %s Failed, ErrorInfo: %s", e.HostIfName, err.Error())
+	}
+	hostBridgeLink, err := netlink.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("Get Bridge Interface: %s Failed, ErrorInfo: %s", brName, err.Error())
+	}
 	hostBridgeLinkIndex := hostBridgeLink.Attrs().Index
 	if err := netlink.LinkSetMasterByIndex(hostLink, hostBridgeLinkIndex); err != nil {
 		return fmt.Errorf("Attach HostLink To Bridge Failed")
@@ -94,9 +135,10 @@ func (e *Veth) Attach(brName, configIp string) error {
 	if err != nil {
 		return fmt.Errorf("Get NetNs Falied, Failed NetNs Path: %s", e.NetNs)
 	}
+	defer netNS.Close()
 
 	var handler = func(hostNS ns.NetNS) error {
-		hostInterface, err := net.InterfaceByName("eth0")
+		hostInterface, err := net.InterfaceByName(e.ContainerIfName)
 		if err != nil {
 			return fmt.Errorf("Get NS Veth Interface Object Failed, Failed NS Path: %s", e.NetNs)
 		}
@@ -112,7 +154,207 @@ func (e *Veth) Attach(brName, configIp string) error {
 	if err := netNS.Do(handler); err != nil {
 		return err
 	}
-	defer netNS.Close()
 	return nil
 
 }
+
+// 删除veth pair, 容器netns不存在或接口已被删除都视为成功
+func (e *Veth) Delete() error {
+	if e.NetNs != "" {
+		var handler = func(hostNS ns.NetNS) error {
+			err := ip.DelLinkByName(e.ContainerIfName)
+			if err != nil && err != ip.ErrLinkNotFound {
+				return fmt.Errorf("Delete Container Interface: %s Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+			}
+			return nil
+		}
+		// netns路径不存在、已不是netns(容器已销毁后路径残留)等无法打开的情况, 容器侧接口随netns一并销毁, 视为已删除
+		netNS, err := ns.GetNS(e.NetNs)
+		if err != nil {
+			log.Warnf("打开NetNs: %s 失败, 视为容器侧接口已删除, 错误信息: %s", e.NetNs, err.Error())
+		} else {
+			defer netNS.Close()
+			if err = netNS.Do(handler); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 容器侧删除后host侧会被内核一并回收, 这里兜底处理netns已经不存在的情况
+	if e.HostIfName != "" && JudgeExist(e.HostIfName) {
+		err := ip.DelLinkByName(e.HostIfName)
+		if err != nil && err != ip.ErrLinkNotFound {
+			return fmt.Errorf("Delete Host Interface: %s Failed, ErrorInfo: %s", e.HostIfName, err.Error())
+		}
+	}
+	return nil
+}
+
+// 校验veth pair: 容器侧接口、地址、默认路由, 以及host侧是否挂载在指定网桥上
+func (e *Veth) Check(brName string) error {
+	containerIp, containerNet, err := net.ParseCIDR(e.ContainerIp)
+	if err != nil {
+		return fmt.Errorf("Reslov Container IP: %s  Failed", e.ContainerIp)
+	}
+	containerNet.IP = containerIp
+	containerGwIp, _, err := net.ParseCIDR(e.ContainerGw)
+	if err != nil {
+		return fmt.Errorf("Reslov Container Gateway: %s  Failed", e.ContainerGw)
+	}
+
+	var handler = func(hostNS ns.NetNS) error {
+		containerLink, err := netlink.LinkByName(e.ContainerIfName)
+		if err != nil {
+			return fmt.Errorf("Container Interface: %s Not Existed On NetNs: %s", e.ContainerIfName, e.NetNs)
+		}
+
+		// 校验容器IP地址
+		addrs, err := netlink.AddrList(containerLink, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("List Container Interface: %s Address Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+		addrFound := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == containerNet.String() {
+				addrFound = true
+				break
+			}
+		}
+		if !addrFound {
+			return fmt.Errorf("Container Interface: %s Missing Address: %s", e.ContainerIfName, containerNet.String())
+		}
+
+		// 校验容器默认路由
+		routes, err := netlink.RouteList(containerLink, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("List Container Interface: %s Route Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+		routeFound := false
+		for _, route := range routes {
+			if isDefaultRoute(route.Dst) && route.Gw.Equal(containerGwIp) {
+				routeFound = true
+				break
+			}
+		}
+		if !routeFound {
+			return fmt.Errorf("Container Interface: %s Missing Default Route Via: %s", e.ContainerIfName, containerGwIp.String())
+		}
+
+		for _, expected := range e.Routes {
+			if isDefaultRoute(&expected.Dst) {
+				continue
+			}
+			gw := expected.GW
+			if gw == nil {
+				gw = containerGwIp
+			}
+			routeFound = false
+			for _, route := range routes {
+				if route.Dst != nil && route.Dst.String() == expected.Dst.String() && route.Gw.Equal(gw) {
+					routeFound = true
+					break
+				}
+			}
+			if !routeFound {
+				return fmt.Errorf("Container Interface: %s Missing Route: %s Via: %s", e.ContainerIfName, expected.Dst.String(), gw.String())
+			}
+		}
+		return nil
+	}
+	if err := ns.WithNetNSPath(e.NetNs, handler); err != nil {
+		return err
+	}
+
+	// 校验host侧veth挂载的网桥
+	hostLink, err := netlink.LinkByName(e.HostIfName)
+	if err != nil {
+		return fmt.Errorf("Host Interface: %s Not Existed", e.HostIfName)
+	}
+	hostBridgeLink, err := netlink.LinkByName(brName)
+	if err != nil {
+		return fmt.Errorf("Bridge Interface: %s Not Existed", brName)
+	}
+	if hostLink.Attrs().MasterIndex != hostBridgeLink.Attrs().Index {
+		return fmt.Errorf("Host Interface: %s Not Attached To Bridge: %s", e.HostIfName, brName)
+	}
+	return nil
+}
+
+func isDefaultRoute(dst *net.IPNet) bool {
+	if dst == nil {
+		return true
+	}
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// 容器侧接口的现有配置, 地址和网关为CIDR格式, 网关使用地址的掩码
+type VethState struct {
+	HostIfName  string
+	ContainerIp string
+	ContainerGw string
+	// 默认路由之外带下一跳的路由
+	Routes []*types.Route
+}
+
+// 读取容器侧接口的现有配置, 供重复ADD时返回之前的结果
+// 接口不存在时返回nil, 存在但缺少地址或默认路由时返回错误
+func (e *Veth) Inspect() (*VethState, error) {
+	state := &VethState{}
+	var peerIndex int
+	var handler = func(hostNS ns.NetNS) error {
+		containerLink, err := netlink.LinkByName(e.ContainerIfName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("Get Container Interface: %s Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+		if _, peerIndex, err = ip.GetVethPeerIfindex(e.ContainerIfName); err != nil {
+			return fmt.Errorf("Get Peer Of Container Interface: %s Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+
+		addrs, err := netlink.AddrList(containerLink, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("List Container Interface: %s Address Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("Container Interface: %s Existed Without Address", e.ContainerIfName)
+		}
+		containerNet := addrs[0].IPNet
+		state.ContainerIp = containerNet.String()
+
+		routes, err := netlink.RouteList(containerLink, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("List Container Interface: %s Route Failed, ErrorInfo: %s", e.ContainerIfName, err.Error())
+		}
+		for _, route := range routes {
+			if route.Gw == nil {
+				continue
+			}
+			if isDefaultRoute(route.Dst) {
+				state.ContainerGw = (&net.IPNet{IP: route.Gw, Mask: containerNet.Mask}).String()
+				continue
+			}
+			state.Routes = append(state.Routes, &types.Route{Dst: *route.Dst, GW: route.Gw})
+		}
+		if state.ContainerGw == "" {
+			return fmt.Errorf("Container Interface: %s Existed Without Default Route", e.ContainerIfName)
+		}
+		return nil
+	}
+	if err := ns.WithNetNSPath(e.NetNs, handler); err != nil {
+		return nil, err
+	}
+	if peerIndex == 0 {
+		return nil, nil
+	}
+
+	// 对端ifindex只在host netns中有效
+	hostLink, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, fmt.Errorf("Get Host Interface By Index: %d Failed, ErrorInfo: %s", peerIndex, err.Error())
+	}
+	state.HostIfName = hostLink.Attrs().Name
+	return state, nil
+}
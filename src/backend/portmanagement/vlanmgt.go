@@ -11,14 +11,18 @@ type Vlan struct {
 	Name       string
 	MasterBr   *netlink.Bridge
 	VlanId     int
+	MTU        int
+	// 是否由本次调用创建, 回滚时只删除自己创建的子接口
+	Created bool
 }
 
-func NewVlanObject(parentInterfaceName, interfaceName string, br *netlink.Bridge, vlanid int) *Vlan {
+func NewVlanObject(parentInterfaceName, interfaceName string, br *netlink.Bridge, vlanid, mtu int) *Vlan {
 	return &Vlan{
 		ParentName: parentInterfaceName,
 		Name:       interfaceName,
 		MasterBr:   br,
 		VlanId:     vlanid,
+		MTU:        mtu,
 	}
 }
 
@@ -27,13 +31,13 @@ func (v *Vlan) Create() (*netlink.Vlan, error) {
 		return nil, fmt.Errorf("Parent Interface: %s Not Existed", v.ParentName)
 	}
 	parentLink, _ := netlink.LinkByName(v.ParentName)
-	parentLinkIndex := parentLink.Attrs().ParentIndex
+	parentLinkIndex := parentLink.Attrs().Index
 
 	if JudgeExist(v.Name) == false {
 		vlan := &netlink.Vlan{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:        v.Name,
-				MTU:         1500,
+				MTU:         v.MTU,
 				TxQLen:      -1,
 				ParentIndex: parentLinkIndex,
 				MasterIndex: v.MasterBr.Attrs().Index,
@@ -45,6 +49,7 @@ func (v *Vlan) Create() (*netlink.Vlan, error) {
 			log.Errorf("Create Vlan Interface: %s Failed, ErrorInfo: %s", v.Name, err.Error())
 			return nil, fmt.Errorf("Create Vlan Interface: %s Failed, ErrorInfo: %s", v.Name, err.Error())
 		}
+		v.Created = true
 
 		//打开vlan接口
 		if err := netlink.LinkSetUp(vlan); err != nil {
@@ -56,7 +61,7 @@ func (v *Vlan) Create() (*netlink.Vlan, error) {
 		vlan := &netlink.Vlan{
 			LinkAttrs: netlink.LinkAttrs{
 				Name:        v.Name,
-				MTU:         1500,
+				MTU:         v.MTU,
 				TxQLen:      -1,
 				ParentIndex: parentLinkIndex,
 				MasterIndex: v.MasterBr.Attrs().Index,
@@ -65,5 +70,51 @@ func (v *Vlan) Create() (*netlink.Vlan, error) {
 		}
 		return vlan, nil
 	}
-	return nil, fmt.Errorf("Create Vlan Interface: %s Failed, ErrorInfo: Unknown Error", v.Name)
+}
+
+// 删除vlan子接口, 所属网桥上还有其他接口时保留
+func (v *Vlan) Delete() error {
+	if JudgeExist(v.Name) == false {
+		return nil
+	}
+	link, err := netlink.LinkByName(v.Name)
+	if err != nil {
+		return fmt.Errorf("Get Vlan Interface: %s Failed, ErrorInfo: %s", v.Name, err.Error())
+	}
+	if masterIndex := link.Attrs().MasterIndex; masterIndex != 0 {
+		inUse, err := hasOtherSlaves(masterIndex, link.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			log.Infof("vlan子接口: %s 所属网桥上仍有其他接口, 跳过删除", v.Name)
+			return nil
+		}
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("Delete Vlan Interface: %s Failed, ErrorInfo: %s", v.Name, err.Error())
+	}
+	return nil
+}
+
+// 校验vlan子接口存在, vlanid正确且挂载在指定网桥上
+func (v *Vlan) Check() error {
+	link, err := netlink.LinkByName(v.Name)
+	if err != nil {
+		return fmt.Errorf("Vlan Interface: %s Not Existed", v.Name)
+	}
+	vlan, ok := link.(*netlink.Vlan)
+	if !ok {
+		return fmt.Errorf("Interface: %s Is Not Vlan Type, Actual Type: %s", v.Name, link.Type())
+	}
+	if vlan.VlanId != v.VlanId {
+		return fmt.Errorf("Vlan Interface: %s VlanId Mismatch, Expected: %d, Actual: %d", v.Name, v.VlanId, vlan.VlanId)
+	}
+	if v.MasterBr != nil {
+		masterLink, err := netlink.LinkByIndex(vlan.Attrs().MasterIndex)
+		if err != nil || masterLink.Attrs().Name != v.MasterBr.Attrs().Name {
+			return fmt.Errorf("Vlan Interface: %s Not Attached To Bridge: %s", v.Name, v.MasterBr.Attrs().Name)
+		}
+	}
+	return nil
 }
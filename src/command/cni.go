@@ -3,6 +3,7 @@ package main
 import (
 	"backend/netallocate"
 	"backend/portmanagement"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,12 +12,18 @@ import (
 	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"util/cnierror"
 	"util/config"
 	"util/log"
 	"util/etcdclient"
@@ -24,56 +31,238 @@ import (
 
 type NetConf struct {
 	types.NetConf
+	// 业务上联口, vlan子接口创建在该接口上, 为空时取ini中server.businessint
 	Master string
 	Mode   string
 	MTU    int
+	// 地址池状态的存储后端, etcd或crd, 默认etcd
+	Backend string   `json:"backend"`
+	Etcd    EtcdConf `json:"etcd"`
+	// 单次ADD/DEL/CHECK的整体超时(秒), 包含etcd请求的重试
+	Timeout int `json:"timeout"`
+	// 配置ipam.type时容器所属的VLAN, 为0时按VLAN映射表匹配
+	VlanId int `json:"vlanId"`
 }
 
-func loadConf(bytes []byte) (*NetConf, string, error) {
+// etcd连接配置, 未配置的字段取ini中etcd段的值
+type EtcdConf struct {
+	etcdclient.Options
+	// key前缀, 不能位于kube-apiserver使用的/registry下
+	Prefix string `json:"prefix"`
+}
+
+// 解析网络配置并填充默认值, 不做校验, DEL在配置不完整时也需要清理接口
+func parseConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{}
 	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+
+	// 网络配置中未指定的项使用ini配置兜底
+	if n.Master == "" {
+		n.Master = config.GlobalConf.GetStr("server", "businessint")
+	}
+	if n.MTU == 0 {
+		n.MTU = 1500
+	}
+	if n.Backend == "" {
+		n.Backend = netallocate.BackendEtcd
+	}
+	if n.Timeout == 0 {
+		n.Timeout = config.GlobalConf.GetInt("server", "cmdtimeout")
+	}
+	if n.Timeout == 0 {
+		n.Timeout = 60
+	}
+	// etcd连接配置未设置的字段取ini配置
+	n.Etcd.SetIniDefaults()
+	if n.Etcd.Prefix == "" {
+		n.Etcd.Prefix = config.GlobalConf.GetStr("etcd", "prefix")
+	}
+	if n.Etcd.Prefix == "" {
+		n.Etcd.Prefix = netallocate.DefaultEtcdPrefix
+	}
+	return n, nil
+}
+
+func loadConf(bytes []byte) (*NetConf, string, error) {
+	n, err := parseConf(bytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if n.Master == "" {
+		return nil, "", fmt.Errorf("uplink interface not configured, set master in netconf or server.businessint in ini")
+	}
+	if n.MTU < 68 {
+		return nil, "", fmt.Errorf("invalid mtu: %d", n.MTU)
+	}
+	if n.Backend != netallocate.BackendEtcd && n.Backend != netallocate.BackendCRD {
+		return nil, "", fmt.Errorf("invalid backend: %s, must be %s or %s", n.Backend, netallocate.BackendEtcd, netallocate.BackendCRD)
+	}
+	if err := netallocate.ValidateEtcdPrefix(n.Etcd.Prefix); err != nil {
+		return nil, "", err
+	}
+	if n.VlanId < 0 || n.VlanId > 4094 {
+		return nil, "", fmt.Errorf("invalid vlanId: %d, must be between 1 and 4094, or 0 to look it up from the vlan map", n.VlanId)
 	}
-	n.MTU = 1500
 	return n, n.CNIVersion, nil
 }
 
-func getIpRange(podNameSpace, podName string) ([]string, string, error) {
-	var (
-		k8sconfig = flag.String("kubeconfig", "/root/.kube/config", "admin kubeconfig")
-		config    *rest.Config
-		err       error
-	)
-	flag.Parse()
-	config, err = clientcmd.BuildConfigFromFlags("", *k8sconfig)
+// 根据网络配置初始化etcd客户端, 证书和私钥必须同时配置, 证书文件轮换后自动重新加载
+func initEtcd(n *NetConf) error {
+	e := n.Etcd
+	if err := e.Validate(); err != nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid etcd config", err.Error())
+	}
+
+	if err := etcdclient.ClientInitWithOptions(&e.Options); err != nil {
+		log.Errorf("初始化etcd客户端失败, endpoints: %s, 错误信息: %s", e.Endpoints, err.Error())
+		return cnierror.New(cnierror.ErrTryAgainLater, "failed to init etcd client", err.Error())
+	}
+	log.Infof("初始化etcd客户端成功, endpoints: %s", e.Endpoints)
+	return nil
+}
+
+// 根据网络配置初始化存储后端, crd后端使用kubeconfig访问apiserver
+func initBackend(n *NetConf) error {
+	if n.Backend == netallocate.BackendEtcd {
+		if err := initEtcd(n); err != nil {
+			return err
+		}
+		if err := netallocate.UseEtcd(n.Etcd.Prefix); err != nil {
+			return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid etcd prefix", err.Error())
+		}
+		return nil
+	}
+
+	config, err := kubeConfig()
+	if err != nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "failed to load kubeconfig", err.Error())
+	}
+	if err = netallocate.UseCRD(config); err != nil {
+		log.Errorf("初始化CRD后端失败, 错误信息: %s", err.Error())
+		return cnierror.New(cnierror.ErrTryAgainLater, "failed to init crd backend", err.Error())
+	}
+	log.Infof("初始化CRD后端成功")
+	return nil
+}
+
+// 解析网络配置并初始化存储后端, 各cmd入口统一调用
+func setupConf(stdinData []byte) (*NetConf, string, error) {
+	n, cniVersion, err := loadConf(stdinData)
+	if err != nil {
+		log.Errorf("解析网络配置失败, 错误信息: %s", err.Error())
+		return nil, "", cnierror.New(cnierror.ErrInvalidNetworkConfig, "failed to load netconf", err.Error())
+	}
+	// 委托IPAM并且指定了vlanId时不需要访问存储后端
+	if delegatedIpam(n) && n.VlanId != 0 {
+		return n, cniVersion, nil
+	}
+	if err = initBackend(n); err != nil {
+		return nil, "", err
+	}
+	return n, cniVersion, nil
+}
+
+var k8sconfig = flag.String("kubeconfig", "/root/.kube/config", "admin kubeconfig")
+
+func kubeConfig() (*rest.Config, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", *k8sconfig)
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to Get Kubeconfig, %v", err)
+		return nil, fmt.Errorf("Failed to Get Kubeconfig, %v", err)
 	}
 	log.Debugln("获取KubeConfig 配置文件成功")
+	return config, nil
+}
+
+// Pod和namespace上的annotation, namespace上的ipgroupname为其下Pod的默认ipgroup
+const (
+	annotationIpv4List = "ipv4list"
+	annotationIpGroup  = "ipgroupname"
+	annotationStickyIp = "stickyip"
+)
+
+// 从Pod对象中获取的分配相关信息
+type podInfo struct {
+	ipRange  []string
+	ipGroup  string
+	uid      string
+	nodeName string
+	sticky   bool
+	// 返回Pod所在namespace的标签, 只在地址池配置了namespaceSelector时调用
+	nsLabels func() (map[string]string, error)
+}
+
+func getPodInfo(podNameSpace, podName string) (*podInfo, error) {
+	config, err := kubeConfig()
+	if err != nil {
+		return nil, err
+	}
 	clientSet, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to Reslov Kubeconfig, %v", err)
+		return nil, fmt.Errorf("Failed to Reslov Kubeconfig, %v", err)
 	}
 	log.Debugln("解析KubeConfig成功, 生产client对象完成")
 
 	pods, err := clientSet.CoreV1().Pods(podNameSpace).List(metav1.ListOptions{})
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to List Pods, %s", err.Error())
+		return nil, fmt.Errorf("Failed to List Pods, %s", err.Error())
 	}
 	//log.Debugf("NameSpace: %s 下存在以下Pods: %s", podNameSpace, pods)
 
+	// namespace对象按需读取, 同一次调用中只读取一次
+	var namespace *corev1.Namespace
+	getNamespace := func() (*corev1.Namespace, error) {
+		if namespace != nil {
+			return namespace, nil
+		}
+		ns, err := clientSet.CoreV1().Namespaces().Get(podNameSpace, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to Get Namespace: %s, %s", podNameSpace, err.Error())
+		}
+		namespace = ns
+		return namespace, nil
+	}
+
 	for _, pod := range pods.Items {
 		if podName != pod.ObjectMeta.Name {
 			continue
 		}
-		ipAnnotation := pod.Annotations["ipv4list"]
-		ipGroup := pod.Annotations["ipgroupname"]
-		ipAnnotationList := strings.Split(ipAnnotation, ",")
+		ipAnnotation := pod.Annotations[annotationIpv4List]
+		ipGroup := pod.Annotations[annotationIpGroup]
+		var ipAnnotationList []string
+		for _, val := range strings.Split(ipAnnotation, ",") {
+			if val = strings.TrimSpace(val); val != "" {
+				ipAnnotationList = append(ipAnnotationList, val)
+			}
+		}
 		log.Debugf("Podname: %s, ipv4亲和性列表: %s",pod.ObjectMeta.Name, ipAnnotationList)
-		return ipAnnotationList, ipGroup, nil
+		if ipGroup == "" {
+			ns, err := getNamespace()
+			if err != nil {
+				return nil, err
+			}
+			ipGroup = ns.Annotations[annotationIpGroup]
+			log.Infof("Pod: %s/%s 未指定ipgroupname, 使用namespace默认ipgroup: %s", podNameSpace, podName, ipGroup)
+		}
+		return &podInfo{
+			ipRange:  ipAnnotationList,
+			ipGroup:  ipGroup,
+			uid:      string(pod.ObjectMeta.UID),
+			nodeName: pod.Spec.NodeName,
+			sticky:   pod.Annotations[annotationStickyIp] == "true",
+			nsLabels: func() (map[string]string, error) {
+				ns, err := getNamespace()
+				if err != nil {
+					return nil, err
+				}
+				return ns.Labels, nil
+			},
+		}, nil
 	}
 	log.Errorf("YAML不存在ipv4的Annotations, Podname: %s",podName )
-	return nil, "", fmt.Errorf("Can not Find IPRange of Pod %s", podName)
+	return nil, fmt.Errorf("Can not Find IPRange of Pod %s", podName)
 }
 
 func loadArgMap(envArgs string) (map[string]string, error) {
@@ -102,21 +291,61 @@ func main() {
 	// 日志初始化
 	log.InitLog()
 
-	// etcd初始化
-	var etcdCluster = []string{"192.168.159.145:2379"}
-	etcdclient.ClientInitWitchCA("/opt/k8s/work/etcd.pem", "/opt/k8s/work/etcd-key.pem", "/opt/k8s/work/ca.pem", 4, 4, 60, etcdCluster)
-	// 加载插件本体
-	skel.PluginMain(cmdAdd, cmdGet, cmdDel, version.All, "todo")
+	// 加载插件本体, etcd在各cmd中根据网络配置初始化
+	skel.PluginMain(cnierror.Wrap(cmdAdd), cnierror.Wrap(cmdCheck), cnierror.Wrap(cmdDel), version.All, "todo")
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	n, cniVersion, err := setupConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+
+	// 任意步骤失败时逆序撤销已完成的步骤
+	rb := &netallocate.Rollback{}
+	defer func() {
+		if err != nil {
+			log.Errorf("cmd add失败, 开始回滚, containerid: %s", args.ContainerID)
+			rb.Run(time.Duration(n.Timeout) * time.Second)
+		}
+	}()
+
 	// 获取namespache
 	netNS, err := ns.GetNS(args.Netns)
 	if err != nil {
 		log.Errorln("获取namespache对象失败")
 		return fmt.Errorf("Get NameSpace Object Failed")
 	}
+	defer netNS.Close()
 	log.Infof("获取NameSpace对象成功, 分配到pause containerid: %s, 对应namespace 路径为: %s", args.ContainerID, netNS.Path())
+
+	if delegatedIpam(n) {
+		return cmdAddDelegated(ctx, rb, n, cniVersion, args, netNS)
+	}
+
+	// 同一containerid+ifname重复ADD时直接返回已分配的结果, 不再重复分配IP
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err != nil && err != netallocate.ErrNotFound {
+		log.Errorf("获取Attachment记录失败, 错误信息: %s", err.Error())
+		return err
+	}
+	if attachment != nil {
+		log.Infof("containerid: %s, ifname: %s 已存在Attachment记录, IP: %s", args.ContainerID, args.IfName, attachment.Ip)
+		vethObject := portmanagement.NewVethObject(args.IfName, netNS.Path(), attachment.Ip, attachment.Gateway, n.MTU)
+		vethObject.HostIfName = attachment.HostIfName
+		if err = vethObject.Check("br" + strconv.Itoa(attachment.VlanId)); err != nil {
+			log.Errorf("已存在的Attachment接口校验失败, 需要先执行DEL, 错误信息: %s", err.Error())
+			return fmt.Errorf("Attachment Of Container: %s Existed But Interface Check Failed, ErrorInfo: %s", args.ContainerID, err.Error())
+		}
+		result, err := attachmentResult(attachment, args, netNS)
+		if err != nil {
+			return err
+		}
+		return types.PrintResult(result, cniVersion)
+	}
+
 	// 解析环境参数
 	argsMap, err := loadArgMap(args.Args)
 	if err != nil {
@@ -128,87 +357,294 @@ func cmdAdd(args *skel.CmdArgs) error {
 	log.Infof("待创建的Pod: %s, 所在的K8S NameSpace: %s", podName, podNameSpace)
 
 	// 分配IP，逻辑根据业务场景制定
-	ipRange, ipGroup, err := getIpRange(podNameSpace, podName)
+	pod, err := getPodInfo(podNameSpace, podName)
 	if err != nil {
 		log.Errorf("根绝Podname获取IP范围失败")
 		return err
 	}
+	ipRange, ipGroup := pod.ipRange, pod.ipGroup
+	if ipGroup == "" {
+		log.Errorf("Pod: %s/%s 以及所在namespace都未指定ipgroupname", podNameSpace, podName)
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "no ipgroup for pod",
+			fmt.Sprintf("pod %s/%s has no %s annotation and namespace %s has no default", podNameSpace, podName, annotationIpGroup, podNameSpace))
+	}
+	if err = netallocate.ValidateGroupName(ipGroup); err != nil {
+		log.Errorf("Pod: %s/%s 的ipgroupname不合法, 错误信息: %s", podNameSpace, podName, err.Error())
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid ipgroupname annotation", err.Error())
+	}
+	// 地址池限制了namespace时, 无权使用的namespace直接拒绝
+	if err = netallocate.CheckNamespaceAccess(ctx, ipGroup, podNameSpace, pod.nsLabels); err != nil {
+		if denied, ok := err.(*netallocate.NamespaceDeniedError); ok {
+			return cnierror.New(cnierror.ErrNamespaceDenied, "namespace not allowed to use ipgroup", denied.Error())
+		}
+		return err
+	}
 
 	log.Infof("PodName: %s, 将从列表: %s 中获取IP地址", podName, ipRange)
-	// 获取IP和网关信息,逻辑根据业务场景制定
-	configIp, configGw, err := netallocate.IpAllocate(ipGroup,ipRange)
+	nodeName := pod.nodeName
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	req := &netallocate.AssignRequest{
+		IpGroup:      ipGroup,
+		IpRange:      ipRange,
+		ContainerId:  args.ContainerID,
+		IfName:       args.IfName,
+		PodNamespace: podNameSpace,
+		PodName:      podName,
+		PodUid:       pod.uid,
+		NodeName:     nodeName,
+		StickyOptIn:  pod.sticky,
+		// 取得IP后根据IP获得vlanid并配置接口
+		Setup: func(ctx context.Context, configIp, configGw string) (int, string, error) {
+			vlanId, err := netallocate.VlanAllocate(ctx, ipGroup, configIp)
+			if err != nil {
+				log.Errorf("获取IP: %s 所属VLAN失败, 错误信息: %s", configIp, err.Error())
+				return 0, "", err
+			}
+			localIfname, err := setupLink(ctx, rb, n, args, netNS, configIp, configGw, vlanId, nil)
+			return vlanId, localIfname, err
+		},
+	}
+	attachment, err = netallocate.Assign(ctx, req, rb.Add)
+	if err == netallocate.ErrNoMatchedIp {
+		log.Errorf("Pod: %s/%s 的ipv4列表与地址池: %s 中的空闲IP没有交集", podNameSpace, podName, ipGroup)
+		return fmt.Errorf("No Free IP In Group: %s Matches ipv4list Of Pod: %s/%s, ipv4list: %s", ipGroup, podNameSpace, podName, strings.Join(ipRange, ","))
+	}
 	if err != nil {
-		log.Errorln("获取PodIP 以及网关IP失败")
+		log.Errorf("Pod: %s/%s 分配IP失败, 错误信息: %s", podNameSpace, podName, err.Error())
 		return err
 	}
-	log.Infof("Pod: %s, 分配IP: %s, 网关: %s", podName, configIp, configGw)
 
-	// 根据IP获得vlanid
-	vlanId := netallocate.VlanAllocate(configIp)
+	// 定义返回
+	result, err := attachmentResult(attachment, args, netNS)
+	if err != nil {
+		return err
+	}
+	return types.PrintResult(result, cniVersion)
+}
 
+// 创建网桥、vlan子接口以及veth并将veth挂载到网桥, 每一步都登记到rb, 返回host侧veth名称
+// 整个过程持有该VLAN的节点锁, 避免其他调用的回滚在veth挂载前删除共用的网桥和子接口
+func setupLink(ctx context.Context, rb *netallocate.Rollback, n *NetConf, args *skel.CmdArgs, netNS ns.NetNS, configIp, configGw string, vlanId int, routes []*types.Route) (string, error) {
 	// 获取归属bond子接口以及网桥,产线默认bond1
 	vlanIdStr := strconv.Itoa(vlanId)
-	businessInt := config.GlobalConf.GetStr("server", "businessint")
+	businessInt := n.Master
 	subBondName := businessInt + "." + vlanIdStr
 	bridgeName := "br" + vlanIdStr
-	log.Infof("Pod: %s, 所属VLAN: %s, 子接口: %s, 网桥: %s", podName, vlanIdStr, subBondName, bridgeName)
+	log.Infof("containerid: %s, 所属VLAN: %s, 子接口: %s, 网桥: %s", args.ContainerID, vlanIdStr, subBondName, bridgeName)
+
+	vlanLock, err := portmanagement.LockVlan(ctx, vlanId)
+	if err != nil {
+		log.Errorf("获取VLAN: %d 的节点锁失败, 错误信息: %s", vlanId, err.Error())
+		return "", err
+	}
+	defer vlanLock.Unlock()
 
 	// 创建网桥
-	bridgeObject := portmanagement.NewBridgeObject(bridgeName)
+	bridgeObject := portmanagement.NewBridgeObject(bridgeName, n.MTU)
 	br, err := bridgeObject.Create()
+	// 启用接口失败时接口已经创建, 需要先登记回滚
+	if bridgeObject.Created {
+		rb.Add("删除网桥: "+bridgeName, undoLocked(vlanId, bridgeObject.Delete))
+	}
 	if err != nil {
 		log.Errorf("创建网桥失败, 错误信息: %s", err.Error())
-		return err
+		return "", err
 	}
 	log.Infof("创建网桥完成, 创建接口: %s", bridgeObject.Name)
 
 	// 创建子接口
-	vlanObject := portmanagement.NewVlanObject(businessInt, subBondName, br, vlanId)
+	vlanObject := portmanagement.NewVlanObject(businessInt, subBondName, br, vlanId, n.MTU)
 	_, err = vlanObject.Create()
+	if vlanObject.Created {
+		rb.Add("删除子接口: "+subBondName, undoLocked(vlanId, vlanObject.Delete))
+	}
 	if err != nil {
 		log.Errorf("创建vlan port 失败，错误信息: %s", err.Error())
-		return err
+		return "", err
 	}
 	log.Infof("创建子接口完成, 创建接口: %s", subBondName)
 
 	// 创建veth
-	vethObject := portmanagement.NewVethObject("eth0", netNS.Path(), configIp, configGw)
+	vethObject := portmanagement.NewVethObject(args.IfName, netNS.Path(), configIp, configGw, n.MTU)
+	vethObject.Routes = routes
 	localIfname, err := vethObject.Create()
 	if err != nil {
 		log.Errorf("创建veth失败, 错误信息: %s", err.Error())
-		return err
+		return "", err
 	}
 	log.Infof("创建veth完成, 创建接口: %s", localIfname)
+	rb.Add("删除veth: "+localIfname, undoFunc(vethObject.Delete))
 
 	// veth 挂载到网桥
 	err = vethObject.Attach(bridgeObject.Name, configIp)
 	if err != nil {
 		log.Errorf("Veth: %s 挂载到网桥: %s 失败", localIfname, bridgeObject.Name)
-		return err
+		return "", err
 	}
 	log.Infof("Veth: %s 挂载到网桥: %s 成功", localIfname, bridgeObject.Name)
+	return localIfname, nil
+}
 
-	// 定义返回
+// 根据Attachment记录构造返回结果
+// 首次ADD和重复ADD都由Attachment记录生成结果, 保证两次返回相同的接口、地址和路由
+func attachmentResult(attachment *netallocate.Attachment, args *skel.CmdArgs, netNS ns.NetNS) (*current.Result, error) {
 	result := &current.Result{}
-	ipc, err := netallocate.IpCfgConv(configIp, configGw)
+	ipc, err := netallocate.IpCfgConv(attachment.Ip, attachment.Gateway)
 	if err != nil {
 		log.Errorf("解析result ipc 失败")
+		return nil, err
 	}
 	result.IPs = append(result.IPs, ipc)
-	_, cniVersion, err := loadConf(args.StdinData)
+	// 与setupLink配置的默认路由一致
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	result.Routes = append(result.Routes, &types.Route{Dst: *defaultNet, GW: ipc.Gateway})
+	setResultInterfaces(result, attachment.HostIfName, args, netNS)
+	return result, nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	log.Infof("开始调用cmd delete, containerid: %s, ifname: %s", args.ContainerID, args.IfName)
+	// DEL可能被重复调用, 也可能在ADD失败后调用, 不校验上联接口等只有ADD需要的配置
+	n, err := parseConf(args.StdinData)
 	if err != nil {
-		log.Errorf("获取CNI版本失败")
+		log.Errorf("解析网络配置失败, 错误信息: %s", err.Error())
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to load netconf", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+
+	if delegatedIpam(n) {
+		return cmdDelDelegated(ctx, n, args)
+	}
+
+	// 先删除容器侧接口, 不依赖存储后端, host侧随之被内核回收
+	if err = deleteVeth(n, args, ""); err != nil {
 		return err
 	}
-	return types.PrintResult(result, cniVersion)
+
+	// 存储后端不可用时只完成接口清理, 残留的IP和记录由GC回收, 避免DEL反复失败
+	if err = initBackend(n); err != nil {
+		log.Warnf("containerid: %s 初始化存储后端失败, IP留待GC回收, 错误信息: %s", args.ContainerID, err.Error())
+		return nil
+	}
+
+	// 根据containerid查找ADD时分配的资源
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err == netallocate.ErrNotFound {
+		log.Infof("containerid: %s 不存在Attachment记录, 无需回收IP", args.ContainerID)
+		return nil
+	}
+	if err != nil {
+		log.Warnf("containerid: %s 获取Attachment记录失败, IP留待GC回收, 错误信息: %s", args.ContainerID, err.Error())
+		return nil
+	}
+
+	// netns已经不存在时host侧接口可能残留, 按记录兜底删除
+	if err = deleteVeth(n, args, attachment.HostIfName); err != nil {
+		return err
+	}
+	if err = netallocate.Unassign(ctx, attachment); err != nil {
+		return err
+	}
+	log.Infof("cmd delete完成, containerid: %s, 回收IP: %s", args.ContainerID, attachment.Ip)
+	return nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
-	log.Infoln("开始调用cmd delete...")
+// 删除veth, netns不存在或接口不存在都视为成功
+func deleteVeth(n *NetConf, args *skel.CmdArgs, hostIfName string) error {
+	vethObject := portmanagement.NewVethObject(args.IfName, args.Netns, "", "", n.MTU)
+	vethObject.HostIfName = hostIfName
+	if err := vethObject.Delete(); err != nil {
+		log.Errorf("删除veth失败, 错误信息: %s", err.Error())
+		return err
+	}
+	log.Infof("删除veth完成, containerid: %s", args.ContainerID)
 	return nil
 }
 
-func cmdGet(args *skel.CmdArgs) error {
-	log.Infoln("开始调用cmd get...")
+func cmdCheck(args *skel.CmdArgs) error {
+	log.Infof("开始调用cmd check, containerid: %s, ifname: %s", args.ContainerID, args.IfName)
+
+	// 解析prevResult
+	n, _, err := setupConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.Timeout)*time.Second)
+	defer cancel()
+	if n.RawPrevResult == nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "required prevResult missing", "")
+	}
+	if err = version.ParsePrevResult(&n.NetConf); err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+	}
+	prevResult, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to convert prevResult", err.Error())
+	}
+
+	netNS, err := ns.GetNS(args.Netns)
+	if err != nil {
+		log.Errorf("获取namespache对象失败, 路径: %s", args.Netns)
+		return cnierror.New(cnierror.ErrUnknownContainer, "failed to open netns", err.Error())
+	}
+	defer netNS.Close()
+
+	if delegatedIpam(n) {
+		return cmdCheckDelegated(ctx, n, args, netNS, prevResult)
+	}
+
+	// 根据containerid查找ADD时分配的资源
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err == netallocate.ErrNotFound {
+		return cnierror.New(cnierror.ErrUnknownContainer, "no attachment recorded for container", args.ContainerID)
+	}
+	if err != nil {
+		return cnierror.New(cnierror.ErrIOFailure, "failed to get attachment", err.Error())
+	}
+
+	// prevResult中必须包含分配的地址和网关
+	ipc, err := netallocate.IpCfgConv(attachment.Ip, attachment.Gateway)
+	if err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to parse allocated address", err.Error())
+	}
+	if !netallocate.HasIpCfg(prevResult.IPs, ipc) {
+		details := fmt.Sprintf("address %s gateway %s not in prevResult", ipc.Address.String(), ipc.Gateway.String())
+		return cnierror.New(cnierror.ErrCheckFailed, "prevResult mismatch", details)
+	}
+
+	if err = checkLink(n, args, netNS, attachment.Ip, attachment.Gateway, attachment.VlanId, attachment.HostIfName, nil); err != nil {
+		return err
+	}
+
+	log.Infof("cmd check完成, containerid: %s, IP: %s", args.ContainerID, attachment.Ip)
+	return nil
+}
+
+// 校验容器接口、地址、路由, host侧veth所挂载的网桥以及业务口上的vlan子接口
+func checkLink(n *NetConf, args *skel.CmdArgs, netNS ns.NetNS, configIp, configGw string, vlanId int, hostIfName string, routes []*types.Route) error {
+	vlanIdStr := strconv.Itoa(vlanId)
+	businessInt := n.Master
+	subBondName := businessInt + "." + vlanIdStr
+	bridgeName := "br" + vlanIdStr
+
+	// 校验容器接口、地址、路由以及host侧veth所挂载的网桥
+	vethObject := portmanagement.NewVethObject(args.IfName, netNS.Path(), configIp, configGw, n.MTU)
+	vethObject.HostIfName = hostIfName
+	vethObject.Routes = routes
+	if err := vethObject.Check(bridgeName); err != nil {
+		log.Errorf("校验veth失败, 错误信息: %s", err.Error())
+		return cnierror.New(cnierror.ErrCheckFailed, "veth check failed", err.Error())
+	}
+
+	// 校验业务口上的vlan子接口
+	br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}
+	vlanObject := portmanagement.NewVlanObject(businessInt, subBondName, br, vlanId, n.MTU)
+	if err := vlanObject.Check(); err != nil {
+		log.Errorf("校验vlan子接口失败, 错误信息: %s", err.Error())
+		return cnierror.New(cnierror.ErrCheckFailed, "vlan check failed", err.Error())
+	}
 	return nil
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"backend/netallocate"
+	"backend/portmanagement"
+	"context"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"net"
+	"util/cnierror"
+	"util/log"
+)
+
+// 网络配置中指定ipam.type时, 通过CNI invoke调用对应的IPAM插件(如host-local)分配地址,
+// 不使用内置地址池, 网桥和vlan子接口的配置方式不变
+
+func delegatedIpam(n *NetConf) bool {
+	return n.IPAM.Type != ""
+}
+
+// 从委托IPAM的结果中取出容器使用的地址, 只配置第一个IPv4地址
+type ipamResult struct {
+	result *current.Result
+	// 以下均为CIDR格式, 网关使用地址的掩码
+	ip      string
+	gateway string
+	// 默认路由之外的IPv4路由
+	routes []*types.Route
+}
+
+// 网关优先取地址上的gateway, 没有时取默认路由的下一跳
+func parseIpamResult(r types.Result) (*ipamResult, error) {
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("Convert IPAM Result Failed, ErrorInfo: %s", err.Error())
+	}
+
+	var ipc *current.IPConfig
+	for _, val := range result.IPs {
+		if val.Version == "4" && val.Address.IP.To4() != nil {
+			ipc = val
+			break
+		}
+	}
+	if ipc == nil {
+		return nil, fmt.Errorf("IPAM Result Contains No IPv4 Address")
+	}
+
+	gw := ipc.Gateway
+	var routes []*types.Route
+	for _, route := range result.Routes {
+		if route.Dst.IP.To4() == nil {
+			continue
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			if gw == nil {
+				gw = route.GW
+			}
+			continue
+		}
+		routes = append(routes, route)
+	}
+	if gw == nil {
+		return nil, fmt.Errorf("IPAM Result Contains No Gateway For Address: %s", ipc.Address.String())
+	}
+
+	result.IPs = []*current.IPConfig{ipc}
+	result.Routes = routes
+	return &ipamResult{
+		result:  result,
+		ip:      ipc.Address.String(),
+		gateway: (&net.IPNet{IP: gw, Mask: ipc.Address.Mask}).String(),
+		routes:  routes,
+	}, nil
+}
+
+// 网络配置指定了vlanId时直接使用, 否则按VLAN映射表匹配
+func delegatedVlan(ctx context.Context, n *NetConf, ip string) (int, error) {
+	if n.VlanId != 0 {
+		return n.VlanId, nil
+	}
+	return netallocate.LookupVlan(ctx, ip)
+}
+
+// 重复ADD时接口已经配置完成, 按接口上的地址和路由返回之前的结果
+// 不能再调用IPAM插件: host-local等插件会再分配一个地址, 后续失败回滚时还会释放正在使用的地址
+// 接口存在但校验失败时返回错误, 需要先执行DEL
+func existingDelegatedResult(ctx context.Context, n *NetConf, args *skel.CmdArgs, netNS ns.NetNS) (*current.Result, error) {
+	vethObject := portmanagement.NewVethObject(args.IfName, netNS.Path(), "", "", n.MTU)
+	state, err := vethObject.Inspect()
+	if err != nil {
+		log.Errorf("容器接口: %s 已存在但读取配置失败, 需要先执行DEL, 错误信息: %s", args.IfName, err.Error())
+		return nil, fmt.Errorf("Interface Of Container: %s Existed But Inspect Failed, ErrorInfo: %s", args.ContainerID, err.Error())
+	}
+	if state == nil {
+		return nil, nil
+	}
+	log.Infof("containerid: %s, ifname: %s 接口已存在, IP: %s", args.ContainerID, args.IfName, state.ContainerIp)
+
+	vlanId, err := delegatedVlan(ctx, n, state.ContainerIp)
+	if err != nil {
+		log.Errorf("获取IP: %s 所属VLAN失败, 错误信息: %s", state.ContainerIp, err.Error())
+		return nil, err
+	}
+	if err = checkLink(n, args, netNS, state.ContainerIp, state.ContainerGw, vlanId, state.HostIfName, state.Routes); err != nil {
+		log.Errorf("已存在的接口校验失败, 需要先执行DEL, 错误信息: %s", err.Error())
+		return nil, fmt.Errorf("Interface Of Container: %s Existed But Check Failed, ErrorInfo: %s", args.ContainerID, err.Error())
+	}
+
+	ipc, err := netallocate.IpCfgConv(state.ContainerIp, state.ContainerGw)
+	if err != nil {
+		return nil, err
+	}
+	result := &current.Result{IPs: []*current.IPConfig{ipc}, Routes: state.Routes}
+	setResultInterfaces(result, state.HostIfName, args, netNS)
+	return result, nil
+}
+
+// 返回结果中记录host侧veth, CHECK时据此校验网桥挂载
+func setResultInterfaces(result *current.Result, hostIfName string, args *skel.CmdArgs, netNS ns.NetNS) {
+	result.Interfaces = []*current.Interface{
+		{Name: hostIfName},
+		{Name: args.IfName, Sandbox: netNS.Path()},
+	}
+	result.IPs[0].Interface = current.Int(1)
+}
+
+func cmdAddDelegated(ctx context.Context, rb *netallocate.Rollback, n *NetConf, cniVersion string, args *skel.CmdArgs, netNS ns.NetNS) error {
+	prev, err := existingDelegatedResult(ctx, n, args, netNS)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		return types.PrintResult(prev, cniVersion)
+	}
+
+	log.Infof("使用IPAM插件: %s 分配地址, containerid: %s", n.IPAM.Type, args.ContainerID)
+	r, err := invoke.DelegateAdd(ctx, n.IPAM.Type, args.StdinData, nil)
+	if err != nil {
+		log.Errorf("IPAM插件: %s 分配地址失败, 错误信息: %s", n.IPAM.Type, err.Error())
+		return err
+	}
+	rb.Add("释放IPAM插件分配的地址", func(ctx context.Context) error {
+		return invoke.DelegateDel(ctx, n.IPAM.Type, args.StdinData, nil)
+	})
+
+	res, err := parseIpamResult(r)
+	if err != nil {
+		log.Errorf("解析IPAM插件: %s 的结果失败, 错误信息: %s", n.IPAM.Type, err.Error())
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "unusable ipam result", err.Error())
+	}
+	log.Infof("containerid: %s, IPAM插件分配IP: %s, 网关: %s", args.ContainerID, res.ip, res.gateway)
+
+	vlanId, err := delegatedVlan(ctx, n, res.ip)
+	if err != nil {
+		log.Errorf("获取IP: %s 所属VLAN失败, 错误信息: %s", res.ip, err.Error())
+		return err
+	}
+
+	hostIfName, err := setupLink(ctx, rb, n, args, netNS, res.ip, res.gateway, vlanId, res.routes)
+	if err != nil {
+		return err
+	}
+
+	setResultInterfaces(res.result, hostIfName, args, netNS)
+	return types.PrintResult(res.result, cniVersion)
+}
+
+// 先删除接口再调用IPAM插件的DEL, 两者都是幂等的
+func cmdDelDelegated(ctx context.Context, n *NetConf, args *skel.CmdArgs) error {
+	if err := deleteVeth(n, args, ""); err != nil {
+		return err
+	}
+	if err := invoke.DelegateDel(ctx, n.IPAM.Type, args.StdinData, nil); err != nil {
+		log.Errorf("IPAM插件: %s 释放地址失败, 错误信息: %s", n.IPAM.Type, err.Error())
+		return err
+	}
+	log.Infof("cmd delete完成, containerid: %s, 已调用IPAM插件: %s 释放地址", args.ContainerID, n.IPAM.Type)
+	return nil
+}
+
+func cmdCheckDelegated(ctx context.Context, n *NetConf, args *skel.CmdArgs, netNS ns.NetNS, prevResult *current.Result) error {
+	if err := invoke.DelegateCheck(ctx, n.IPAM.Type, args.StdinData, nil); err != nil {
+		log.Errorf("IPAM插件: %s 校验失败, 错误信息: %s", n.IPAM.Type, err.Error())
+		return err
+	}
+
+	res, err := parseIpamResult(prevResult)
+	if err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+	}
+	var hostIfName string
+	for _, iface := range prevResult.Interfaces {
+		if iface.Sandbox == "" {
+			hostIfName = iface.Name
+			break
+		}
+	}
+	if hostIfName == "" {
+		return cnierror.New(cnierror.ErrCheckFailed, "prevResult mismatch", "host interface not in prevResult")
+	}
+
+	vlanId, err := delegatedVlan(ctx, n, res.ip)
+	if err != nil {
+		return cnierror.New(cnierror.ErrIOFailure, "failed to resolve vlan", err.Error())
+	}
+	if err = checkLink(n, args, netNS, res.ip, res.gateway, vlanId, hostIfName, res.routes); err != nil {
+		return err
+	}
+	log.Infof("cmd check完成, containerid: %s, IP: %s", args.ContainerID, res.ip)
+	return nil
+}
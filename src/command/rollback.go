@@ -0,0 +1,25 @@
+package main
+
+import (
+	"backend/portmanagement"
+	"context"
+)
+
+// 适配不需要ctx的撤销步骤
+func undoFunc(undo func() error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return undo()
+	}
+}
+
+// 删除共用的网桥和vlan子接口时持有该VLAN的节点锁, 与其他调用的setupLink互斥
+func undoLocked(vlanId int, undo func() error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		vlanLock, err := portmanagement.LockVlan(ctx, vlanId)
+		if err != nil {
+			return err
+		}
+		defer vlanLock.Unlock()
+		return undo()
+	}
+}
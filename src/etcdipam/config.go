@@ -0,0 +1,138 @@
+package main
+
+import (
+	"backend/netallocate"
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"util/cnierror"
+	"util/config"
+	"util/etcdclient"
+	"util/log"
+)
+
+// 网络配置, 插件只读取ipam段
+type NetConf struct {
+	types.NetConf
+	IPAM *IPAMConfig `json:"ipam"`
+}
+
+// ipam段配置, 未配置的etcd项取ini中etcd段的值
+type IPAMConfig struct {
+	Type string `json:"type"`
+	// 默认地址池以及候选IP列表, Pod通过annotation指定时以annotation为准
+	IpGroup  string   `json:"ipGroup"`
+	Ipv4List []string `json:"ipv4List"`
+	// 是否为所有Pod开启固定IP, 地址池开启sticky时同样生效
+	Sticky bool `json:"sticky"`
+	// 从Pod annotations读取地址池、候选IP和固定IP开关, Pod未指定地址池时取namespace的annotation
+	// 为空时只在地址池配置了namespaceSelector时访问apiserver
+	Annotations *AnnotationConf `json:"annotations"`
+	Kubeconfig  string          `json:"kubeconfig"`
+	// 返回给主插件的路由, 为空时返回经过地址池网关的默认路由
+	Routes []*types.Route `json:"routes"`
+	// 地址池状态的存储后端, etcd或crd, 默认etcd
+	Backend string   `json:"backend"`
+	Etcd    EtcdConf `json:"etcd"`
+	// 单次ADD/DEL/CHECK的整体超时(秒), 包含etcd请求的重试
+	Timeout int `json:"timeout"`
+}
+
+// etcd连接配置, 与主插件的etcd段相同
+type EtcdConf struct {
+	etcdclient.Options
+	// key前缀, 不能位于kube-apiserver使用的/registry下
+	Prefix string `json:"prefix"`
+}
+
+// annotation名称, 默认与主插件相同
+type AnnotationConf struct {
+	IpGroup  string `json:"ipGroup"`
+	Ipv4List string `json:"ipv4List"`
+	Sticky   string `json:"sticky"`
+}
+
+func loadConf(bytes []byte) (*NetConf, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	if n.IPAM == nil {
+		return nil, fmt.Errorf("ipam section missing in netconf")
+	}
+	c := n.IPAM
+
+	if c.Annotations != nil {
+		if c.Annotations.IpGroup == "" {
+			c.Annotations.IpGroup = "ipgroupname"
+		}
+		if c.Annotations.Ipv4List == "" {
+			c.Annotations.Ipv4List = "ipv4list"
+		}
+		if c.Annotations.Sticky == "" {
+			c.Annotations.Sticky = "stickyip"
+		}
+	}
+	if c.Kubeconfig == "" {
+		c.Kubeconfig = "/root/.kube/config"
+	}
+	if c.Backend == "" {
+		c.Backend = netallocate.BackendEtcd
+	}
+	if c.Timeout == 0 {
+		c.Timeout = config.GlobalConf.GetInt("server", "cmdtimeout")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 60
+	}
+
+	c.Etcd.SetIniDefaults()
+	if c.Etcd.Prefix == "" {
+		c.Etcd.Prefix = config.GlobalConf.GetStr("etcd", "prefix")
+	}
+	if c.Etcd.Prefix == "" {
+		c.Etcd.Prefix = netallocate.DefaultEtcdPrefix
+	}
+
+	if c.Backend != netallocate.BackendEtcd && c.Backend != netallocate.BackendCRD {
+		return nil, fmt.Errorf("invalid backend: %s, must be %s or %s", c.Backend, netallocate.BackendEtcd, netallocate.BackendCRD)
+	}
+	if err := netallocate.ValidateEtcdPrefix(c.Etcd.Prefix); err != nil {
+		return nil, err
+	}
+	if c.IpGroup != "" {
+		if err := netallocate.ValidateGroupName(c.IpGroup); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// 根据ipam配置初始化存储后端
+func initBackend(c *IPAMConfig) error {
+	if c.Backend == netallocate.BackendCRD {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+		if err != nil {
+			return cnierror.New(cnierror.ErrInvalidNetworkConfig, "failed to load kubeconfig", err.Error())
+		}
+		if err = netallocate.UseCRD(restConfig); err != nil {
+			log.Errorf("初始化CRD后端失败, 错误信息: %s", err.Error())
+			return cnierror.New(cnierror.ErrTryAgainLater, "failed to init crd backend", err.Error())
+		}
+		return nil
+	}
+
+	e := c.Etcd
+	if err := e.Validate(); err != nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid etcd config", err.Error())
+	}
+	if err := etcdclient.ClientInitWithOptions(&e.Options); err != nil {
+		log.Errorf("初始化etcd客户端失败, endpoints: %s, 错误信息: %s", e.Endpoints, err.Error())
+		return cnierror.New(cnierror.ErrTryAgainLater, "failed to init etcd client", err.Error())
+	}
+	if err := netallocate.UseEtcd(c.Etcd.Prefix); err != nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid etcd prefix", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"backend/netallocate"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"util/cnierror"
+	"util/config"
+	"util/log"
+)
+
+// 独立的IPAM插件, 只负责从地址池分配和回收IP, 接口由主插件(如macvlan、ipvlan)配置
+// 地址池、分配记录以及固定IP与multi-vlan-cni共用同一份数据
+func main() {
+	var confPath = flag.String("confPath", "/etc/cni/conf/default.ini", "load conf file")
+	flag.Parse()
+
+	config.GlobalConf.CfgInit(*confPath)
+	log.InitLog()
+
+	skel.PluginMain(cnierror.Wrap(cmdAdd), cnierror.Wrap(cmdCheck), cnierror.Wrap(cmdDel), version.All, "etcdipam")
+}
+
+// CNI_ARGS中由kubelet传入的Pod信息
+type k8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+}
+
+// 本次分配使用的地址池以及Pod信息
+type podInfo struct {
+	namespace string
+	name      string
+	uid       string
+	nodeName  string
+	ipGroup   string
+	ipRange   []string
+	sticky    bool
+	// 返回Pod所在namespace的标签, 只在地址池配置了namespaceSelector时调用
+	nsLabels func() (map[string]string, error)
+}
+
+// 解析网络配置并初始化存储后端, 各cmd入口统一调用
+func setupConf(stdinData []byte) (*NetConf, error) {
+	n, err := loadConf(stdinData)
+	if err != nil {
+		log.Errorf("解析ipam配置失败, 错误信息: %s", err.Error())
+		return nil, cnierror.New(cnierror.ErrInvalidNetworkConfig, "failed to load ipam config", err.Error())
+	}
+	if err = initBackend(n.IPAM); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// 按需创建apiserver客户端以及读取namespace, 同一次调用中只读取一次
+type kubeReader struct {
+	kubeconfig string
+	clientSet  kubernetes.Interface
+	namespace  *corev1.Namespace
+}
+
+func (r *kubeReader) client() (kubernetes.Interface, error) {
+	if r.clientSet != nil {
+		return r.clientSet, nil
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags("", r.kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to Get Kubeconfig, %v", err)
+	}
+	clientSet, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to Reslov Kubeconfig, %v", err)
+	}
+	r.clientSet = clientSet
+	return r.clientSet, nil
+}
+
+func (r *kubeReader) getNamespace(name string) (*corev1.Namespace, error) {
+	if r.namespace != nil {
+		return r.namespace, nil
+	}
+	clientSet, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	ns, err := clientSet.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to Get Namespace: %s, %s", name, err.Error())
+	}
+	r.namespace = ns
+	return r.namespace, nil
+}
+
+// 地址池依次取Pod annotation、namespace annotation以及ipam配置, 候选IP和固定IP开关优先取Pod annotations
+func getPodInfo(c *IPAMConfig, args *skel.CmdArgs) (*podInfo, error) {
+	k8s := k8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8s); err != nil {
+		return nil, cnierror.New(cnierror.ErrInvalidNetworkConfig, "failed to parse CNI_ARGS", err.Error())
+	}
+	reader := &kubeReader{kubeconfig: c.Kubeconfig}
+	info := &podInfo{
+		namespace: string(k8s.K8S_POD_NAMESPACE),
+		name:      string(k8s.K8S_POD_NAME),
+		ipGroup:   c.IpGroup,
+		ipRange:   c.Ipv4List,
+		sticky:    c.Sticky,
+	}
+	info.nsLabels = func() (map[string]string, error) {
+		ns, err := reader.getNamespace(info.namespace)
+		if err != nil {
+			return nil, err
+		}
+		return ns.Labels, nil
+	}
+	if c.Annotations == nil || info.name == "" {
+		return info, nil
+	}
+
+	clientSet, err := reader.client()
+	if err != nil {
+		return nil, err
+	}
+	pod, err := clientSet.CoreV1().Pods(info.namespace).Get(info.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to Get Pod %s/%s, %s", info.namespace, info.name, err.Error())
+	}
+	info.uid = string(pod.UID)
+	info.nodeName = pod.Spec.NodeName
+	if val := pod.Annotations[c.Annotations.IpGroup]; val != "" {
+		info.ipGroup = val
+	} else {
+		ns, err := reader.getNamespace(info.namespace)
+		if err != nil {
+			return nil, err
+		}
+		if val := ns.Annotations[c.Annotations.IpGroup]; val != "" {
+			info.ipGroup = val
+		}
+	}
+	if val := pod.Annotations[c.Annotations.Ipv4List]; val != "" {
+		info.ipRange = nil
+		for _, ip := range strings.Split(val, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				info.ipRange = append(info.ipRange, ip)
+			}
+		}
+	}
+	if pod.Annotations[c.Annotations.Sticky] == "true" {
+		info.sticky = true
+	}
+	return info, nil
+}
+
+// 构造返回给主插件的结果, 未配置routes时返回经过网关的默认路由
+func ipamResult(c *IPAMConfig, dns types.DNS, ip, gateway string) (*current.Result, error) {
+	ipc, err := netallocate.IpCfgConv(ip, gateway)
+	if err != nil {
+		return nil, err
+	}
+	routes := c.Routes
+	if len(routes) == 0 {
+		_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+		routes = []*types.Route{{Dst: *defaultDst, GW: ipc.Gateway}}
+	}
+	return &current.Result{
+		IPs:    []*current.IPConfig{ipc},
+		Routes: routes,
+		DNS:    dns,
+	}, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	n, err := setupConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	c := n.IPAM
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Timeout)*time.Second)
+	defer cancel()
+
+	// 同一containerid+ifname重复ADD时返回已分配的IP
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err != nil && err != netallocate.ErrNotFound {
+		log.Errorf("获取Attachment记录失败, 错误信息: %s", err.Error())
+		return err
+	}
+	if attachment != nil {
+		log.Infof("containerid: %s, ifname: %s 已存在Attachment记录, IP: %s", args.ContainerID, args.IfName, attachment.Ip)
+		result, err := ipamResult(c, n.DNS, attachment.Ip, attachment.Gateway)
+		if err != nil {
+			return err
+		}
+		return types.PrintResult(result, n.CNIVersion)
+	}
+
+	pod, err := getPodInfo(c, args)
+	if err != nil {
+		log.Errorf("获取Pod信息失败, 错误信息: %s", err.Error())
+		return err
+	}
+	if pod.ipGroup == "" {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "no ipgroup configured", "set ipam.ipGroup or the ipgroup annotation of the pod or its namespace")
+	}
+	if err = netallocate.ValidateGroupName(pod.ipGroup); err != nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "invalid ipgroup", err.Error())
+	}
+	ipGroup := pod.ipGroup
+	if err = netallocate.CheckNamespaceAccess(ctx, ipGroup, pod.namespace, pod.nsLabels); err != nil {
+		if denied, ok := err.(*netallocate.NamespaceDeniedError); ok {
+			return cnierror.New(cnierror.ErrNamespaceDenied, "namespace not allowed to use ipgroup", denied.Error())
+		}
+		return err
+	}
+
+	// 任意步骤失败时逆序撤销已完成的步骤
+	rb := &netallocate.Rollback{}
+	defer func() {
+		if err != nil {
+			log.Errorf("cmd add失败, 开始回滚, containerid: %s", args.ContainerID)
+			rb.Run(time.Duration(c.Timeout) * time.Second)
+		}
+	}()
+
+	nodeName := pod.nodeName
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	req := &netallocate.AssignRequest{
+		IpGroup:      ipGroup,
+		IpRange:      pod.ipRange,
+		ContainerId:  args.ContainerID,
+		IfName:       args.IfName,
+		PodNamespace: pod.namespace,
+		PodName:      pod.name,
+		PodUid:       pod.uid,
+		NodeName:     nodeName,
+		StickyOptIn:  pod.sticky,
+	}
+	attachment, err = netallocate.Assign(ctx, req, rb.Add)
+	if err == netallocate.ErrNoMatchedIp {
+		return fmt.Errorf("No Free IP In Group: %s Matches ipv4list: %s", ipGroup, strings.Join(pod.ipRange, ","))
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := ipamResult(c, n.DNS, attachment.Ip, attachment.Gateway)
+	if err != nil {
+		return err
+	}
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := setupConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.IPAM.Timeout)*time.Second)
+	defer cancel()
+
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err == netallocate.ErrNotFound {
+		log.Infof("containerid: %s 不存在Attachment记录, 无需回收IP", args.ContainerID)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("获取Attachment记录失败, 错误信息: %s", err.Error())
+		return err
+	}
+
+	if err = netallocate.Unassign(ctx, attachment); err != nil {
+		return err
+	}
+	log.Infof("cmd delete完成, containerid: %s, 回收IP: %s", args.ContainerID, attachment.Ip)
+	return nil
+}
+
+// 校验Attachment记录存在, prevResult中包含分配的地址和网关, 并且分配记录中IP仍归该容器所有
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := setupConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if n.RawPrevResult == nil {
+		return cnierror.New(cnierror.ErrInvalidNetworkConfig, "required prevResult missing", "")
+	}
+	if err = version.ParsePrevResult(&n.NetConf); err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to parse prevResult", err.Error())
+	}
+	prevResult, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to convert prevResult", err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.IPAM.Timeout)*time.Second)
+	defer cancel()
+
+	attachment, err := netallocate.GetAttachment(ctx, args.ContainerID, args.IfName)
+	if err == netallocate.ErrNotFound {
+		return cnierror.New(cnierror.ErrUnknownContainer, "no attachment recorded for container", args.ContainerID)
+	}
+	if err != nil {
+		return cnierror.New(cnierror.ErrIOFailure, "failed to get attachment", err.Error())
+	}
+
+	ipc, err := netallocate.IpCfgConv(attachment.Ip, attachment.Gateway)
+	if err != nil {
+		return cnierror.New(cnierror.ErrDecodingFailure, "failed to parse allocated address", err.Error())
+	}
+	if !netallocate.HasIpCfg(prevResult.IPs, ipc) {
+		details := fmt.Sprintf("address %s gateway %s not in prevResult", ipc.Address.String(), ipc.Gateway.String())
+		return cnierror.New(cnierror.ErrCheckFailed, "prevResult mismatch", details)
+	}
+
+	allocation, err := netallocate.GetAllocation(ctx, attachment.IpGroup, attachment.Ip)
+	if err == netallocate.ErrNotFound {
+		return cnierror.New(cnierror.ErrCheckFailed, "allocation missing", attachment.Ip)
+	}
+	if err != nil {
+		return cnierror.New(cnierror.ErrIOFailure, "failed to get allocation", err.Error())
+	}
+	if allocation.ContainerId != args.ContainerID || allocation.ReleasedAt != nil {
+		details := fmt.Sprintf("ip %s held by container %s", attachment.Ip, allocation.ContainerId)
+		return cnierror.New(cnierror.ErrCheckFailed, "allocation owner mismatch", details)
+	}
+	log.Infof("cmd check完成, containerid: %s, IP: %s", args.ContainerID, attachment.Ip)
+	return nil
+}
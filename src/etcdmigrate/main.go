@@ -0,0 +1,72 @@
+package main
+
+import (
+	"backend/netallocate"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"util/config"
+	"util/etcdclient"
+	"util/log"
+)
+
+// 一次性迁移工具, 将/registry下旧布局的地址池数据迁移到新前缀下
+// 用法: etcdmigrate -groups app,db [-prefix /multivlancni] [-delete] [-dry-run]
+func main() {
+	var (
+		confPath = flag.String("confPath", "/etc/cni/conf/default.ini", "load conf file")
+		groups   = flag.String("groups", "", "comma separated ipgroups to migrate")
+		prefix   = flag.String("prefix", "", "target etcd prefix, default etcd.prefix in ini or "+netallocate.DefaultEtcdPrefix)
+		delOld   = flag.Bool("delete", false, "delete legacy keys after migration")
+		dryRun   = flag.Bool("dry-run", false, "only report what would be migrated")
+		// 旧版本iprange转换时, 没有手工写入pool的地址池使用的网关规则
+		gatewayRule = flag.String("gateway-rule", "", "gatewayRule of pools converted from legacy iprange, first or last")
+	)
+	flag.Parse()
+
+	config.GlobalConf.CfgInit(*confPath)
+	log.InitLog()
+
+	// /registry下还有kube-apiserver的数据, 无法安全地遍历, 必须显式指定ipgroup
+	var groupList []string
+	for _, val := range strings.Split(*groups, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			groupList = append(groupList, val)
+		}
+	}
+	if len(groupList) == 0 {
+		fmt.Fprintln(os.Stderr, "-groups is required")
+		os.Exit(2)
+	}
+
+	if *prefix == "" {
+		*prefix = config.GlobalConf.GetStr("etcd", "prefix")
+	}
+	if *prefix == "" {
+		*prefix = netallocate.DefaultEtcdPrefix
+	}
+
+	if err := etcdclient.ClientInitFromIni(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if err := netallocate.UseEtcd(*prefix); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	template := &netallocate.Pool{GatewayRule: *gatewayRule}
+	result, err := netallocate.MigrateLegacyKeys(context.Background(), groupList, template, *delOld, *dryRun)
+	if result != nil {
+		fmt.Printf("copied: %d, skipped: %d, conflict: %d, deleted: %d, converted: %d\n", result.Copied, result.Skipped, result.Conflict, result.Deleted, result.Converted)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if result.Conflict > 0 {
+		os.Exit(1)
+	}
+}
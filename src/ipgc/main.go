@@ -0,0 +1,292 @@
+package main
+
+import (
+	"backend/netallocate"
+	"context"
+	"flag"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"util/config"
+	"util/etcdclient"
+	"util/log"
+)
+
+// 泄漏IP回收工具, 占用者Pod已不存在、UID不一致或已结束的分配记录超过宽限期后归还IP
+// 同时回收过期的固定IP保留记录, 同一时间只允许一个实例运行
+// 用法: ipgc [-dry-run] [-groups app,db] [-interval 10m]
+var (
+	confPath      = flag.String("confPath", "/etc/cni/conf/default.ini", "load conf file")
+	kubeconfig    = flag.String("kubeconfig", "/root/.kube/config", "admin kubeconfig")
+	backendType   = flag.String("backend", netallocate.BackendEtcd, "state backend, etcd or crd")
+	prefix        = flag.String("prefix", "", "etcd prefix, default etcd.prefix in ini or "+netallocate.DefaultEtcdPrefix)
+	groups        = flag.String("groups", "", "comma separated ipgroups, default all")
+	dryRun        = flag.Bool("dry-run", false, "only report leaked ips")
+	gracePeriod   = flag.Duration("grace", 10*time.Minute, "only release allocations older than this")
+	rate          = flag.Float64("rate", 5, "max releases per second, 0 for unlimited")
+	maxReleases   = flag.Int("max", 0, "max releases per round, 0 for unlimited")
+	interval      = flag.Duration("interval", 0, "run every interval as an agent, 0 to run once")
+	lockTTL       = flag.Int("lock-ttl", 30, "lock ttl in seconds")
+	lockNamespace = flag.String("lock-namespace", "kube-system", "namespace of the lease lock for crd backend")
+)
+
+const lockName = "multivlancni-ipgc"
+
+// kubelet配置Pod主网络时使用的接口名称, 只有主网络的IP会出现在Pod的status.podIP中
+const primaryIfName = "eth0"
+
+func main() {
+	flag.Parse()
+	config.GlobalConf.CfgInit(*confPath)
+	log.InitLog()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var groupList []string
+	for _, val := range strings.Split(*groups, ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			if err := netallocate.ValidateGroupName(val); err != nil {
+				return err
+			}
+			groupList = append(groupList, val)
+		}
+	}
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return fmt.Errorf("Failed to Get Kubeconfig, %v", err)
+	}
+	clientSet, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to Reslov Kubeconfig, %v", err)
+	}
+
+	switch *backendType {
+	case netallocate.BackendEtcd:
+		if *prefix == "" {
+			*prefix = config.GlobalConf.GetStr("etcd", "prefix")
+		}
+		if *prefix == "" {
+			*prefix = netallocate.DefaultEtcdPrefix
+		}
+		if err = etcdclient.ClientInitFromIni(); err != nil {
+			return err
+		}
+		if err = netallocate.UseEtcd(*prefix); err != nil {
+			return err
+		}
+	case netallocate.BackendCRD:
+		if err = netallocate.UseCRD(restConfig); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid backend: %s, must be %s or %s", *backendType, netallocate.BackendEtcd, netallocate.BackendCRD)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	return runExclusive(ctx, clientSet, func(ctx context.Context) error {
+		for {
+			result, err := collect(ctx, clientSet, groupList)
+			if result != nil {
+				report(result)
+			}
+			if *interval == 0 {
+				if err == nil && result.Failed > 0 {
+					err = fmt.Errorf("%d releases failed", result.Failed)
+				}
+				return err
+			}
+			if err != nil {
+				log.Errorf("本轮GC失败, 错误信息: %s", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(*interval):
+			}
+		}
+	})
+}
+
+// 每轮开始时列出所有Pod, 分配时间超过宽限期的记录其Pod必然已在列表中
+func collect(ctx context.Context, clientSet kubernetes.Interface, groupList []string) (*netallocate.GcResult, error) {
+	pods, err := clientSet.CoreV1().Pods("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to List Pods, %s", err.Error())
+	}
+	podIndex := make(map[string]*corev1.Pod, len(pods.Items))
+	// 旧版本转换的占位记录没有Pod信息, 按运行中Pod的IP核对
+	podIps := make(map[string]bool, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		podIndex[pod.Namespace+"/"+pod.Name] = pod
+		if pod.Status.PodIP != "" && !pod.Spec.HostNetwork && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			podIps[pod.Status.PodIP] = true
+		}
+	}
+
+	return netallocate.CollectGarbage(ctx, groupList, &netallocate.GcOptions{
+		GracePeriod: *gracePeriod,
+		Rate:        *rate,
+		MaxReleases: *maxReleases,
+		DryRun:      *dryRun,
+		OwnerAlive: func(ctx context.Context, a *netallocate.Allocation) (bool, string, error) {
+			if a.ContainerId == netallocate.LegacyContainerId {
+				if podIps[strings.Split(a.Ip, "/")[0]] {
+					return true, "", nil
+				}
+				return false, "legacy ip not used by any pod", nil
+			}
+			pod := podIndex[a.PodNamespace+"/"+a.PodName]
+			switch {
+			case pod == nil:
+				return false, "pod not found", nil
+			case a.PodUid != "" && string(pod.UID) != a.PodUid:
+				return false, "pod uid changed to " + string(pod.UID), nil
+			case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+				return false, "pod " + strings.ToLower(string(pod.Status.Phase)), nil
+			case a.IfName == primaryIfName && pod.Status.PodIP != "" && pod.Status.PodIP != strings.Split(a.Ip, "/")[0]:
+				// 同名同UID的Pod已经使用其他IP, 例如ADD失败重试后分配了新IP, 旧记录未回收
+				return false, "pod ip changed to " + pod.Status.PodIP, nil
+			}
+			return true, "", nil
+		},
+	})
+}
+
+func report(result *netallocate.GcResult) {
+	for _, r := range result.Records {
+		status := "done"
+		if *dryRun {
+			status = "dry-run"
+		} else if r.Error != "" {
+			status = r.Error
+		}
+		fmt.Printf("%s\t%s\t%s/%s\t%s\t%s\t%s\n", r.IpGroup, r.Ip, r.PodNamespace, r.PodName, r.Action, r.Reason, status)
+	}
+	fmt.Printf("scanned: %d, orphaned: %d, released: %d, failed: %d, deferred: %d\n",
+		result.Scanned, result.Orphaned, result.Released, result.Failed, result.Deferred)
+	log.Infof("GC完成, 扫描: %d, 泄漏: %d, 回收: %d, 失败: %d, 推迟: %d",
+		result.Scanned, result.Orphaned, result.Released, result.Failed, result.Deferred)
+}
+
+// 持有锁期间执行fn, 失去锁时fn的ctx被取消
+// etcd后端使用etcd锁, 单次运行时锁已被持有直接退出; crd后端使用apiserver的Lease选主
+func runExclusive(ctx context.Context, clientSet kubernetes.Interface, fn func(ctx context.Context) error) error {
+	identity, _ := os.Hostname()
+	identity = fmt.Sprintf("%s-%d", identity, os.Getpid())
+
+	if *backendType == netallocate.BackendCRD {
+		lock, err := resourcelock.New(resourcelock.LeasesResourceLock, *lockNamespace, lockName,
+			clientSet.CoreV1(), clientSet.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: identity})
+		if err != nil {
+			return err
+		}
+		ttl := time.Duration(*lockTTL) * time.Second
+		leCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var runErr error
+		heldErr := make(chan error, 1)
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   ttl,
+			RenewDeadline:   ttl * 2 / 3,
+			RetryPeriod:     ttl / 6,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					runErr = fn(ctx)
+					cancel()
+				},
+				OnStoppedLeading: func() {
+					cancel()
+				},
+				// 单次运行时Lease被其他实例持有并且未过期, 与etcd后端一致直接退出
+				// 持有者异常退出时Lease不再续期, 过期后由本实例接管
+				OnNewLeader: func(leader string) {
+					if *interval != 0 || leader == "" || leader == identity || !leaseLive(lock, leader) {
+						return
+					}
+					// 回调可能被多次触发, 已经记录过时不再阻塞
+					select {
+					case heldErr <- fmt.Errorf("another ipgc is running"):
+					default:
+					}
+					cancel()
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		elector.Run(leCtx)
+		select {
+		case err = <-heldErr:
+			return err
+		default:
+		}
+		return runErr
+	}
+
+	mutex, err := etcdclient.Etcdclient.NewMutex(*prefix+"/gc/lock", *lockTTL)
+	if err != nil {
+		return err
+	}
+	defer mutex.Close()
+	if *interval == 0 {
+		err = mutex.TryLock(ctx)
+	} else {
+		err = mutex.Lock(ctx)
+	}
+	if err == etcdclient.ErrLocked {
+		return fmt.Errorf("another ipgc is running")
+	}
+	if err != nil {
+		return err
+	}
+	defer mutex.Unlock()
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-mutex.Done():
+			log.Errorf("GC锁的会话已过期, 停止回收")
+			cancel()
+		case <-lockCtx.Done():
+		}
+	}()
+	return fn(lockCtx)
+}
+
+// Lease仍由leader持有并且在有效期内
+func leaseLive(lock resourcelock.Interface, leader string) bool {
+	record, err := lock.Get()
+	if err != nil || record.HolderIdentity != leader {
+		return false
+	}
+	expires := record.RenewTime.Add(time.Duration(record.LeaseDurationSeconds) * time.Second)
+	return time.Now().Before(expires)
+}
@@ -0,0 +1,52 @@
+package cnierror
+
+import (
+	"context"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"util/etcdclient"
+)
+
+// multi-vlan-cni与etcdipam共用的错误码以及转换
+
+// CNI规范约定的错误码, 参考SPEC.md中Well-known Error Codes
+const (
+	ErrUnknownContainer     uint = 3
+	ErrIOFailure            uint = 5
+	ErrDecodingFailure      uint = 6
+	ErrInvalidNetworkConfig uint = 7
+	ErrTryAgainLater        uint = 11
+
+	// 插件自定义错误码从100开始
+	ErrCheckFailed     uint = 101
+	ErrNamespaceDenied uint = 102
+)
+
+func New(code uint, msg string, details string) *types.Error {
+	return &types.Error{
+		Code:    code,
+		Msg:     msg,
+		Details: details,
+	}
+}
+
+// etcd暂时性故障或整体超时转换为ErrTryAgainLater, 其余错误原样返回
+func Convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*types.Error); ok {
+		return err
+	}
+	if etcdclient.IsRetryable(err) || err == context.DeadlineExceeded {
+		return New(ErrTryAgainLater, "temporary failure, try again later", err.Error())
+	}
+	return err
+}
+
+// 包装cmd入口, 返回给运行时的错误统一经过Convert
+func Wrap(cmd func(args *skel.CmdArgs) error) func(args *skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		return Convert(cmd(args))
+	}
+}
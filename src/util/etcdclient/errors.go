@@ -0,0 +1,113 @@
+package etcdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sync"
+	"time"
+	"util/log"
+)
+
+// 可重试错误的最大重试次数以及退避时间
+const (
+	maxRetries     = 5
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// 访问etcd失败时返回的错误, Retryable为true表示是选主、节点不可用等暂时性故障
+// 调用方可以稍后重试, 为false表示参数、权限等重试也无法恢复的错误
+type Error struct {
+	Op        string
+	Key       string
+	Retryable bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s Etcd Failed, Key: %s, Error Info: %s", e.Op, e.Key, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// 判断错误是否为暂时性故障
+func IsRetryable(err error) bool {
+	var etcdErr *Error
+	return errors.As(err, &etcdErr) && etcdErr.Retryable
+}
+
+// idempotent为false的操作(事务)只在请求确定没有被执行时重试
+// 超时、选主切换时请求可能已经生效, 重试会得到错误的比较结果
+func retryable(err error, idempotent bool) bool {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrNoLeader, rpctypes.ErrTooManyRequests:
+		return true
+	case rpctypes.ErrLeaderChanged, rpctypes.ErrTimeout, rpctypes.ErrTimeoutDueToLeaderFail, rpctypes.ErrTimeoutDueToConnectionLost:
+		return idempotent
+	}
+	if err == context.DeadlineExceeded {
+		return idempotent
+	}
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return true
+	case codes.DeadlineExceeded:
+		return idempotent
+	}
+	return false
+}
+
+// 重试抖动使用的随机源, 按进程播种, 并发调用时加锁
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// 第attempt次重试前的等待时间, 指数退避并加入随机抖动, 避免各节点同时重试
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	jitter.Lock()
+	defer jitter.Unlock()
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// 执行一次etcd请求, 每次尝试的超时为RequestTimeout, 暂时性故障在ctx结束前按退避重试
+func (e *EtcdClient) do(ctx context.Context, op, key string, idempotent bool, fn func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, time.Duration(e.RequestTimeout)*time.Second)
+		err := fn(reqCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		// ctx本身结束时不再重试, 错误仍标记为可重试, 由上层决定是否再次调用
+		etcdErr := &Error{Op: op, Key: key, Retryable: retryable(err, idempotent), Err: err}
+		if ctx.Err() != nil {
+			etcdErr.Err, etcdErr.Retryable = ctx.Err(), true
+			return etcdErr
+		}
+		if !etcdErr.Retryable || attempt >= maxRetries {
+			return etcdErr
+		}
+
+		delay := retryDelay(attempt)
+		log.Warnf("%s etcd失败, key: %s, %s后第%d次重试, 错误信息: %s", op, key, delay, attempt+1, err.Error())
+		select {
+		case <-ctx.Done():
+			etcdErr.Err, etcdErr.Retryable = ctx.Err(), true
+			return etcdErr
+		case <-time.After(delay):
+		}
+	}
+}
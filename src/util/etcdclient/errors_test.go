@@ -0,0 +1,65 @@
+package etcdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		// 幂等操作和事务分别是否重试
+		idempotent    bool
+		nonIdempotent bool
+	}{
+		{name: "no leader", err: rpctypes.ErrGRPCNoLeader, idempotent: true, nonIdempotent: true},
+		{name: "too many requests", err: rpctypes.ErrGRPCRequestTooManyRequests, idempotent: true, nonIdempotent: true},
+		{name: "leader changed", err: rpctypes.ErrGRPCLeaderChanged, idempotent: true, nonIdempotent: false},
+		{name: "server timeout", err: rpctypes.ErrGRPCTimeout, idempotent: true, nonIdempotent: false},
+		{name: "timeout due to leader fail", err: rpctypes.ErrGRPCTimeoutDueToLeaderFail, idempotent: true, nonIdempotent: false},
+		{name: "client deadline", err: context.DeadlineExceeded, idempotent: true, nonIdempotent: false},
+		{name: "grpc deadline", err: status.Error(codes.DeadlineExceeded, "context deadline exceeded"), idempotent: true, nonIdempotent: false},
+		{name: "transport unavailable", err: status.Error(codes.Unavailable, "transport is closing"), idempotent: true, nonIdempotent: true},
+		{name: "permission denied", err: rpctypes.ErrGRPCPermissionDenied, idempotent: false, nonIdempotent: false},
+		{name: "key not found", err: rpctypes.ErrGRPCKeyNotFound, idempotent: false, nonIdempotent: false},
+		{name: "canceled", err: context.Canceled, idempotent: false, nonIdempotent: false},
+		{name: "plain error", err: errors.New("boom"), idempotent: false, nonIdempotent: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := retryable(c.err, true); got != c.idempotent {
+				t.Errorf("retryable(idempotent) = %v, want %v", got, c.idempotent)
+			}
+			if got := retryable(c.err, false); got != c.nonIdempotent {
+				t.Errorf("retryable(non-idempotent) = %v, want %v", got, c.nonIdempotent)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	retry := &Error{Op: "Get", Key: "/k", Retryable: true, Err: rpctypes.ErrGRPCNoLeader}
+	fatal := &Error{Op: "Get", Key: "/k", Retryable: false, Err: rpctypes.ErrGRPCPermissionDenied}
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "retryable", err: retry, want: true},
+		{name: "not retryable", err: fatal, want: false},
+		{name: "wrapped retryable", err: fmt.Errorf("allocate: %w", retry), want: true},
+		{name: "raw grpc error", err: rpctypes.ErrGRPCNoLeader, want: false},
+	}
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.want {
+			t.Errorf("%s: IsRetryable = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
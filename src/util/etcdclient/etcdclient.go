@@ -2,17 +2,40 @@ package etcdclient
 
 import (
 	"context"
-	"time"
+	"errors"
 	"fmt"
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/mvcc/mvccpb"
-	"crypto/tls"
-    "crypto/x509"
-	"io/ioutil"
+	"sort"
+	"strings"
+	"util/log"
 )
 
 var Etcdclient *EtcdClient
 
+// key不存在时返回的错误, 调用方通过IsKeyNotFound区分"没有数据"和"访问失败"
+type KeyNotFoundError struct {
+	Key string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Get Etcd Key Failed, Key: %s, Error Info: No Key", e.Key)
+}
+
+func IsKeyNotFound(err error) bool {
+	var notFound *KeyNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// List返回的键值以及版本信息
+type KeyValue struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+}
+
 type EtcdClient struct {
 	Leaseid clientv3.LeaseID
 	Client  *clientv3.Client
@@ -25,162 +48,234 @@ type EtcdClient struct {
 }
 
 // 常规初始化, 不带ca认证的情况下
-func ClientInit(dialTimeout, requestTimeout int , leaseTime int64, endpoints []string) error {
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
-		DialTimeout: time.Duration(dialTimeout) * time.Second,
+func ClientInit(dialTimeout, requestTimeout int, leaseTime int64, endpoints []string) error {
+	return ClientInitWithOptions(&Options{
+		Endpoints:      endpoints,
+		DialTimeout:    dialTimeout,
+		RequestTimeout: requestTimeout,
+		LeaseTime:      leaseTime,
 	})
-	if err != nil {
-		return fmt.Errorf("Init Common EtcdClient Error, ErrorInfo: %s", err.Error())
-	}
+}
 
-	// 创建租约
-	lease := clientv3.NewLease(cli)
+// 安全初始化， 带ca认证的情况下
+func ClientInitWitchCA(etcdCert, etcdCertKey, etcdCa string, dialTimeout, requestTimeout int, leaseTime int64, endpoints []string) error {
+	return ClientInitWithOptions(&Options{
+		Endpoints:      endpoints,
+		DialTimeout:    dialTimeout,
+		RequestTimeout: requestTimeout,
+		LeaseTime:      leaseTime,
+		CertFile:       etcdCert,
+		KeyFile:        etcdCertKey,
+		CaFile:         etcdCa,
+	})
+}
 
-	//设置租约时间
-	leaseResp, err := lease.Grant(context.TODO(), leaseTime)
-	if err != nil {
-		return fmt.Errorf("Set Leasetime Error, ErrorInfo: %s", err.Error())
+// 启动一个协程序用于后台自动续租, 续期停止后返回
+func (e *EtcdClient) LeaseReRate() {
+	if e.KeepRespChan == nil {
+		return
+	}
+	//每秒会续租一次，所以就会受到一次应答
+	for e.KeepResp = range e.KeepRespChan {
 	}
+	log.Errorf("全局租约: %x 自动续期失败", e.Leaseid)
+}
 
-	// 获取租约ID
-	leaseId := leaseResp.ID
+// 以下方法中ctx控制整体截止时间, 每次请求的超时为RequestTimeout, 暂时性故障自动重试
+// 失败时返回*Error, 通过IsRetryable判断是否为暂时性故障
 
-	// 创建一个自动续期的协程
-	keepRespChan, err := lease.KeepAlive(context.TODO(), leaseId)
-	if err != nil {
-		return fmt.Errorf("Set Auto Lease Rerate Error, ErrorInfo: %s", err.Error())
-	}	
-
-	Etcdclient = &EtcdClient {
-		Leaseid: leaseId,
-		Client:  cli,
-		Lease:  lease,
-		DialTimeout: dialTimeout,
-		RequestTimeout: requestTimeout,
-		Leasetime: leaseTime,
-		KeepRespChan: keepRespChan,
+// 持久写入, 不绑定租约, IP地址池、分配记录等数据必须使用该方法
+func (e *EtcdClient) Put(ctx context.Context, key, value string) error {
+	return e.do(ctx, "Put", key, true, func(ctx context.Context) error {
+		_, err := e.Client.Put(ctx, key, value)
+		return err
+	})
+}
+
+// 绑定客户端租约写入, 进程退出停止续租后key会随租约过期被删除
+// 只适用于心跳、在线状态等随进程存活的数据, 需要创建客户端时LeaseTime大于0
+func (e *EtcdClient) PutWithLease(ctx context.Context, key, value string) error {
+	if e.Lease == nil {
+		return fmt.Errorf("Put Data To Etcd Failed, Key: %s, Error Info: Global Lease Not Enabled", key)
 	}
-	return nil 
+	return e.do(ctx, "Put With Lease", key, true, func(ctx context.Context) error {
+		_, err := e.Client.Put(ctx, key, value, clientv3.WithLease(e.Leaseid))
+		return err
+	})
 }
 
+// 精确读取key的值, key不存在时返回KeyNotFoundError
+func (e *EtcdClient) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := e.GetWithRevision(ctx, key)
+	return value, err
+}
 
-// 安全初始化， 带ca认证的情况下
-func ClientInitWitchCA(etcdCert, etcdCertKey, etcdCa string, dialTimeout, requestTimeout int, leaseTime int64, endpoints []string) error {
-    cert, err := tls.LoadX509KeyPair(etcdCert, etcdCertKey)
-    if err != nil {
-        return fmt.Errorf("set Tls Cert Falied, ErrorInfo: %s", err.Error())
-    }
-
-    caData, err := ioutil.ReadFile(etcdCa)
-    if err != nil {
-        return fmt.Errorf("set caData Falied, ErrorInfo: %s", err.Error())
-    }
-
-    pool := x509.NewCertPool()
-    pool.AppendCertsFromPEM(caData)
-
-    _tlsConfig := &tls.Config{
-        Certificates: []tls.Certificate{cert},
-        RootCAs:      pool,
-    }	
-
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
-		DialTimeout: time.Duration(dialTimeout) * time.Second,
-		TLS:       _tlsConfig,
+// 精确读取key的值以及ModRevision, 供CompareAndSwap使用
+func (e *EtcdClient) GetWithRevision(ctx context.Context, key string) (string, int64, error) {
+	var getResp *clientv3.GetResponse
+	err := e.do(ctx, "Get", key, true, func(ctx context.Context) error {
+		var err error
+		getResp, err = e.Client.Get(ctx, key)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("Init Common EtcdClient Error, ErrorInfo: %s", err.Error())
+		return "", 0, err
+	}
+
+	if len(getResp.Kvs) == 0 {
+		return "", 0, &KeyNotFoundError{Key: key}
 	}
 
-	// 创建租约
-	lease := clientv3.NewLease(cli)
+	return string(getResp.Kvs[0].Value), getResp.Kvs[0].ModRevision, nil
+}
+
+// 按前缀读取所有key, 结果按key排序, 没有匹配的key时返回空列表
+func (e *EtcdClient) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	kvs, _, err := e.listWithRevision(ctx, prefix)
+	return kvs, err
+}
 
-	//设置租约时间
-	leaseResp, err := lease.Grant(context.TODO(), leaseTime)
+// 按前缀读取所有key, 同时返回读取时etcd的revision, 供Watch从该revision之后继续监听
+func (e *EtcdClient) listWithRevision(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	if prefix == "" {
+		return nil, 0, fmt.Errorf("List Data From Etcd Failed, Error Info: Empty Prefix")
+	}
+	var getResp *clientv3.GetResponse
+	err := e.do(ctx, "List", prefix, true, func(ctx context.Context) error {
+		var err error
+		getResp, err = e.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Set Leasetime Error, ErrorInfo: %s", err.Error())
+		return nil, 0, err
 	}
 
-	// 获取租约ID
-	leaseId := leaseResp.ID
+	kvs := make([]KeyValue, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		kvs = append(kvs, toKeyValue(kv))
+	}
+	return kvs, getResp.Header.Revision, nil
+}
 
-	// 创建一个自动续期的协程
-	keepRespChan, err := lease.KeepAlive(context.TODO(), leaseId)
+// 按前缀只读取key, 不返回value, 结果按key排序
+func (e *EtcdClient) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("List Keys From Etcd Failed, Error Info: Empty Prefix")
+	}
+	var getResp *clientv3.GetResponse
+	err := e.do(ctx, "List Keys", prefix, true, func(ctx context.Context) error {
+		var err error
+		getResp, err = e.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Set Auto Lease Rerate Error, ErrorInfo: %s", err.Error())
-	}	
-
-	Etcdclient = &EtcdClient {
-		Leaseid: leaseId,
-		Client:  cli,
-		Lease:  lease,
-		DialTimeout: dialTimeout,
-		RequestTimeout: requestTimeout,
-		Leasetime: leaseTime,
-		KeepRespChan: keepRespChan,
+		return nil, err
 	}
-	return nil
-}
 
+	keys := make([]string, 0, len(getResp.Kvs))
+	for _, kv := range getResp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys, nil
+}
 
-// 启动一个协程序用于后台自动续租
-func (e *EtcdClient) LeaseReRate() {
-	for {
-		select {
-		case e.KeepResp = <-e.KeepRespChan:
-			if e.KeepRespChan == nil {
-				fmt.Println("自动续期失败")
-			} else { //每秒会续租一次，所以就会受到一次应答
-				continue
-			}
-		}
+func toKeyValue(kv *mvccpb.KeyValue) KeyValue {
+	return KeyValue{
+		Key:            string(kv.Key),
+		Value:          string(kv.Value),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
 	}
 }
 
-func (e *EtcdClient) Put(key, value string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.RequestTimeout) * time.Second)
-	_, err := e.Client.Put(ctx, key, value, clientv3.WithLease(e.Leaseid))
-	cancel()
+// 仅当key的ModRevision与modRevision一致时持久写入, modRevision为0表示要求key不存在
+// 返回false表示key已被其他客户端修改, 调用方需要重新读取后重试
+func (e *EtcdClient) CompareAndSwap(ctx context.Context, key, value string, modRevision int64) (bool, error) {
+	var txnResp *clientv3.TxnResponse
+	err := e.do(ctx, "Compare And Swap", key, false, func(ctx context.Context) error {
+		var err error
+		txnResp, err = e.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(clientv3.OpPut(key, value)).
+			Commit()
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Put Data To Etcd Failed, Key: %s, Value: %s, Error Info: %s", key, value, err.Error())
+		return false, err
 	}
-	return nil
+	return txnResp.Succeeded, nil
 }
 
-func (e *EtcdClient) Get(key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.RequestTimeout) * time.Second)
-	getResp, err := e.Client.Get(ctx, key, clientv3.WithPrefix())
-	cancel()
+// 仅当key的ModRevision与modRevision一致时删除, 返回false表示key已被其他客户端修改或删除
+func (e *EtcdClient) CompareAndDelete(ctx context.Context, key string, modRevision int64) (bool, error) {
+	var txnResp *clientv3.TxnResponse
+	err := e.do(ctx, "Compare And Delete", key, false, func(ctx context.Context) error {
+		var err error
+		txnResp, err = e.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+			Then(clientv3.OpDelete(key)).
+			Commit()
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("Get Data From Etcd Failed, Key: %s, Error Info: %s", key, err.Error())
+		return false, err
 	}
+	return txnResp.Succeeded, nil
+}
 
-	if len(getResp.Kvs) == 0 {
-		return "", fmt.Errorf("Get Etcd Key Failed , Error Info: No Key")
+// 多个key的条件更新, conds中每个key的ModRevision都与期望值一致时写入puts并删除deletes, 期望值为0表示要求key不存在
+// 返回false表示有key已被其他客户端修改, 此时不做任何修改
+func (e *EtcdClient) CompareAndSwapAll(ctx context.Context, conds map[string]int64, puts map[string]string, deletes []string) (bool, error) {
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	var keys []string
+	for key, modRevision := range conds {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", modRevision))
 	}
+	for key, value := range puts {
+		ops = append(ops, clientv3.OpPut(key, value))
+		keys = append(keys, key)
+	}
+	for _, key := range deletes {
+		ops = append(ops, clientv3.OpDelete(key))
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	return string(getResp.Kvs[0].Value), nil
+	var txnResp *clientv3.TxnResponse
+	err := e.do(ctx, "Compare And Swap All", strings.Join(keys, ","), false, func(ctx context.Context) error {
+		var err error
+		txnResp, err = e.Client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return txnResp.Succeeded, nil
 }
 
-func (e *EtcdClient) WatchCfg(key string) {
-    ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-    //这里ctx感知到cancel则会关闭watcher
-    watchRespChan := e.Client.Watch(ctx, key)
-
-    // 处理kv变化事件
-    for watchResp := range watchRespChan {
-        for _, event := range watchResp.Events {
-            switch event.Type {
-            case mvccpb.PUT:
-                fmt.Println("Put:", string(event.Kv.Value))
-            case mvccpb.DELETE:
-                fmt.Println("Delete")
-            }
-        }
-    }
+// 精确删除key, key不存在时不返回错误
+func (e *EtcdClient) Delete(ctx context.Context, key string) error {
+	return e.do(ctx, "Delete", key, true, func(ctx context.Context) error {
+		_, err := e.Client.Delete(ctx, key)
+		return err
+	})
 }
 
-
+// 删除前缀下的所有key, 返回删除的数量, 为避免误删整个etcd不允许空前缀
+// 重试时已删除的key不再计数
+func (e *EtcdClient) DeletePrefix(ctx context.Context, prefix string) (int64, error) {
+	if prefix == "" {
+		return 0, fmt.Errorf("Delete Data From Etcd Failed, Error Info: Empty Prefix")
+	}
+	var deleted int64
+	err := e.do(ctx, "Delete Prefix", prefix, true, func(ctx context.Context) error {
+		delResp, err := e.Client.Delete(ctx, prefix, clientv3.WithPrefix())
+		if err == nil {
+			deleted += delResp.Deleted
+		}
+		return err
+	})
+	return deleted, err
+}
@@ -0,0 +1,208 @@
+package etcdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	"sync"
+	"time"
+)
+
+// TryLock时锁已被其他会话持有
+var ErrLocked = errors.New("Etcd Mutex Is Held By Another Session")
+
+// 由调用方管理生命周期的租约, 与客户端初始化时创建的全局租约相互独立
+// 创建后自动续期, 续期失败或租约过期时Done关闭, Revoke后绑定该租约的key全部删除
+type Lease struct {
+	ID     clientv3.LeaseID
+	client *EtcdClient
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (e *EtcdClient) GrantLease(ctx context.Context, ttl int64) (*Lease, error) {
+	var grantResp *clientv3.LeaseGrantResponse
+	err := e.do(ctx, "Grant Lease", "", true, func(ctx context.Context) error {
+		var err error
+		grantResp, err = e.Client.Grant(ctx, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keepCtx, keepCancel := context.WithCancel(context.Background())
+	keepRespChan, err := e.Client.KeepAlive(keepCtx, grantResp.ID)
+	if err != nil {
+		keepCancel()
+		return nil, fmt.Errorf("Keep Alive Lease Failed, LeaseId: %x, Error Info: %s", grantResp.ID, err.Error())
+	}
+
+	l := &Lease{ID: grantResp.ID, client: e, cancel: keepCancel, done: make(chan struct{})}
+	go func() {
+		// 续期应答需要及时取走, channel关闭说明续期停止
+		for range keepRespChan {
+		}
+		close(l.done)
+	}()
+	return l, nil
+}
+
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// 以该租约写入, 租约撤销或过期后key被删除
+func (l *Lease) Put(ctx context.Context, key, value string) error {
+	return l.client.do(ctx, "Put With Lease", key, true, func(ctx context.Context) error {
+		_, err := l.client.Client.Put(ctx, key, value, clientv3.WithLease(l.ID))
+		return err
+	})
+}
+
+// 停止续期并撤销租约, 可重复调用
+func (l *Lease) Revoke() error {
+	var err error
+	l.once.Do(func() {
+		l.cancel()
+		e := l.client
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(e.RequestTimeout)*time.Second)
+		_, err = e.Client.Revoke(ctx, l.ID)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("Revoke Lease Failed, LeaseId: %x, Error Info: %s", l.ID, err.Error())
+		}
+	})
+	return err
+}
+
+// 基于会话的分布式锁, 会话租约过期时锁自动释放, 此时Done关闭, 持有者需要停止临界区内的操作
+type Mutex struct {
+	client  *EtcdClient
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+	key     string
+}
+
+// key为锁的前缀, ttl为会话租约时长(秒), 进程异常退出后最多ttl秒锁被释放
+func (e *EtcdClient) NewMutex(key string, ttl int) (*Mutex, error) {
+	session, err := concurrency.NewSession(e.Client, concurrency.WithTTL(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("Create Etcd Session Failed, Error Info: %s", err.Error())
+	}
+	return &Mutex{client: e, session: session, mutex: concurrency.NewMutex(session, key), key: key}, nil
+}
+
+// 阻塞直到获得锁或ctx结束
+func (m *Mutex) Lock(ctx context.Context) error {
+	if err := m.mutex.Lock(ctx); err != nil {
+		return fmt.Errorf("Lock Etcd Mutex Failed, Error Info: %s", err.Error())
+	}
+	return nil
+}
+
+// 不等待, 锁已被持有时返回ErrLocked
+// etcd 3.4的concurrency.Mutex没有TryLock, 按其key规则(前缀/租约ID, 最早创建者持有锁)先写入自己的key,
+// 不是最早创建者时删除该key; 是持有者时再调用Lock, 复用已写入的key立即返回
+func (m *Mutex) TryLock(ctx context.Context) error {
+	client := m.client.Client
+	myKey := fmt.Sprintf("%s/%x", m.key, m.session.Lease())
+	cmp := clientv3.Compare(clientv3.CreateRevision(myKey), "=", 0)
+	put := clientv3.OpPut(myKey, "", clientv3.WithLease(m.session.Lease()))
+	get := clientv3.OpGet(myKey)
+	getOwner := clientv3.OpGet(m.key+"/", clientv3.WithFirstCreate()...)
+	resp, err := client.Txn(ctx).If(cmp).Then(put, getOwner).Else(get, getOwner).Commit()
+	if err != nil {
+		return fmt.Errorf("Lock Etcd Mutex Failed, Error Info: %s", err.Error())
+	}
+	myRev := resp.Header.Revision
+	if !resp.Succeeded {
+		myRev = resp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+	ownerKey := resp.Responses[1].GetResponseRange().Kvs
+	if len(ownerKey) != 0 && ownerKey[0].CreateRevision != myRev {
+		if _, err = client.Delete(ctx, myKey); err != nil {
+			return fmt.Errorf("Delete Etcd Mutex Key Failed, Key: %s, Error Info: %s", myKey, err.Error())
+		}
+		return ErrLocked
+	}
+	return m.Lock(ctx)
+}
+
+func (m *Mutex) Unlock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.client.RequestTimeout)*time.Second)
+	err := m.mutex.Unlock(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Unlock Etcd Mutex Failed, Error Info: %s", err.Error())
+	}
+	return nil
+}
+
+func (m *Mutex) Done() <-chan struct{} {
+	return m.session.Done()
+}
+
+// 关闭会话并撤销租约, 持有的锁随之释放
+func (m *Mutex) Close() error {
+	return m.session.Close()
+}
+
+// 基于会话的leader选举, 会话租约过期时自动失去leader身份, 此时Done关闭
+type Election struct {
+	client   *EtcdClient
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+// prefix为选举的前缀, 参与同一选举的进程使用相同的prefix
+func (e *EtcdClient) NewElection(prefix string, ttl int) (*Election, error) {
+	session, err := concurrency.NewSession(e.Client, concurrency.WithTTL(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("Create Etcd Session Failed, Error Info: %s", err.Error())
+	}
+	return &Election{client: e, session: session, election: concurrency.NewElection(session, prefix)}, nil
+}
+
+// 阻塞直到成为leader或ctx结束, value一般为进程标识, 通过Leader可以查到当前leader
+func (el *Election) Campaign(ctx context.Context, value string) error {
+	if err := el.election.Campaign(ctx, value); err != nil {
+		return fmt.Errorf("Campaign Election Failed, Error Info: %s", err.Error())
+	}
+	return nil
+}
+
+// 主动放弃leader身份
+func (el *Election) Resign() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(el.client.RequestTimeout)*time.Second)
+	err := el.election.Resign(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("Resign Election Failed, Error Info: %s", err.Error())
+	}
+	return nil
+}
+
+// 返回当前leader的value, 没有leader时返回KeyNotFoundError
+func (el *Election) Leader(ctx context.Context) (string, error) {
+	resp, err := el.election.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return "", &KeyNotFoundError{Key: "election leader"}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Get Election Leader Failed, Error Info: %s", err.Error())
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (el *Election) Done() <-chan struct{} {
+	return el.session.Done()
+}
+
+// 关闭会话并撤销租约, 是leader时随之让出
+func (el *Election) Close() error {
+	return el.session.Close()
+}
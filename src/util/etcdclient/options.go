@@ -0,0 +1,289 @@
+package etcdclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go.etcd.io/etcd/clientv3"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"util/config"
+)
+
+// 客户端配置, 未配置证书、CA和ServerName时使用明文连接
+type Options struct {
+	Endpoints      []string `json:"endpoints"`
+	DialTimeout    int      `json:"dialTimeout"`
+	RequestTimeout int      `json:"requestTimeout"`
+	// 大于0时创建自动续期的全局租约供PutWithLease使用, 为0时不创建
+	// 单次执行的CNI插件不需要全局租约, 只有常驻进程按需开启
+	LeaseTime int64 `json:"leaseTime"`
+
+	// 客户端证书和私钥必须同时配置, CaFile为空时使用系统CA
+	// 证书文件被替换后在下次建立连接时自动加载, 常驻进程无需重启
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+	CaFile     string `json:"caFile"`
+	ServerName string `json:"serverName"`
+	// 跳过服务端证书校验, 只用于实验环境
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+
+	// etcd开启RBAC时的用户名和密码
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// 未设置的字段依次取ini配置文件[etcd]段以及默认值, 调用前需要先加载config.GlobalConf
+// 全局租约只由常驻进程按需开启, 不从ini读取
+func (o *Options) SetIniDefaults() {
+	if len(o.Endpoints) == 0 {
+		if endpoints := config.GlobalConf.GetStr("etcd", "endpoints"); endpoints != "" {
+			o.Endpoints = strings.Split(endpoints, ",")
+		}
+	}
+	if o.CertFile == "" {
+		o.CertFile = config.GlobalConf.GetStr("etcd", "certfile")
+	}
+	if o.KeyFile == "" {
+		o.KeyFile = config.GlobalConf.GetStr("etcd", "keyfile")
+	}
+	if o.CaFile == "" {
+		o.CaFile = config.GlobalConf.GetStr("etcd", "cafile")
+	}
+	if o.ServerName == "" {
+		o.ServerName = config.GlobalConf.GetStr("etcd", "servername")
+	}
+	if !o.InsecureSkipVerify {
+		o.InsecureSkipVerify = config.GlobalConf.GetBool("etcd", "insecureskipverify")
+	}
+	if o.Username == "" {
+		o.Username = config.GlobalConf.GetStr("etcd", "username")
+	}
+	if o.Password == "" {
+		o.Password = config.GlobalConf.GetStr("etcd", "password")
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = config.GlobalConf.GetInt("etcd", "dialtimeout")
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 4
+	}
+	if o.RequestTimeout == 0 {
+		o.RequestTimeout = config.GlobalConf.GetInt("etcd", "requesttimeout")
+	}
+	if o.RequestTimeout == 0 {
+		o.RequestTimeout = 4
+	}
+}
+
+// 校验必须成对出现的配置
+func (o *Options) Validate() error {
+	if len(o.Endpoints) == 0 {
+		return fmt.Errorf("etcd endpoints not configured")
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("etcd certFile and keyFile must be set together")
+	}
+	if (o.Username == "") != (o.Password == "") {
+		return fmt.Errorf("etcd username and password must be set together")
+	}
+	return nil
+}
+
+func (o *Options) tlsEnabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.CaFile != "" || o.ServerName != "" || o.InsecureSkipVerify
+}
+
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if !o.tlsEnabled() {
+		return nil, nil
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("certFile and keyFile must be set together")
+	}
+
+	reloader := &certReloader{certFile: o.CertFile, keyFile: o.KeyFile, caFile: o.CaFile}
+	cfg := &tls.Config{ServerName: o.ServerName}
+	if o.CertFile != "" {
+		// 启动时先加载一次, 证书有问题时尽早失败
+		if _, err := reloader.clientCertificate(nil); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = reloader.clientCertificate
+	}
+
+	switch {
+	case o.InsecureSkipVerify:
+		cfg.InsecureSkipVerify = true
+	case o.CaFile != "":
+		if _, err := reloader.rootCAs(); err != nil {
+			return nil, err
+		}
+		// RootCAs在建立连接后无法替换, 关闭内置校验改为在VerifyConnection中用最新的CA校验
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = reloader.verifyConnection
+	}
+	return cfg, nil
+}
+
+// 根据配置创建客户端, LeaseTime大于0时同时创建自动续期的全局租约
+func NewClient(opts *Options) (*EtcdClient, error) {
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Set Tls Config Failed, ErrorInfo: %s", err.Error())
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		DialTimeout: time.Duration(opts.DialTimeout) * time.Second,
+		TLS:         tlsConfig,
+		Username:    opts.Username,
+		Password:    opts.Password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Init EtcdClient Error, ErrorInfo: %s", err.Error())
+	}
+	client := &EtcdClient{
+		Client:         cli,
+		DialTimeout:    opts.DialTimeout,
+		RequestTimeout: opts.RequestTimeout,
+		Leasetime:      opts.LeaseTime,
+	}
+	if opts.LeaseTime <= 0 {
+		return client, nil
+	}
+
+	// 创建租约并设置租约时间
+	lease := clientv3.NewLease(cli)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.RequestTimeout)*time.Second)
+	leaseResp, err := lease.Grant(ctx, opts.LeaseTime)
+	cancel()
+	if err != nil {
+		cli.Close()
+		return nil, fmt.Errorf("Set Leasetime Error, ErrorInfo: %s", err.Error())
+	}
+
+	// 创建一个自动续期的协程
+	keepRespChan, err := lease.KeepAlive(context.TODO(), leaseResp.ID)
+	if err != nil {
+		cli.Close()
+		return nil, fmt.Errorf("Set Auto Lease Rerate Error, ErrorInfo: %s", err.Error())
+	}
+	client.Leaseid = leaseResp.ID
+	client.Lease = lease
+	client.KeepRespChan = keepRespChan
+	return client, nil
+}
+
+// 根据配置初始化全局客户端Etcdclient
+func ClientInitWithOptions(opts *Options) error {
+	client, err := NewClient(opts)
+	if err != nil {
+		return err
+	}
+	Etcdclient = client
+	return nil
+}
+
+// 命令行工具按ini配置文件[etcd]段初始化全局客户端
+func ClientInitFromIni() error {
+	opts := &Options{}
+	opts.SetIniDefaults()
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return ClientInitWithOptions(opts)
+}
+
+// 证书文件修改时间变化时重新加载
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	pool    *x509.CertPool
+	caMod   time.Time
+}
+
+func modTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mod, err := modTime(r.certFile, r.keyFile)
+	if err != nil && r.cert == nil {
+		return nil, fmt.Errorf("set Tls Cert Falied, ErrorInfo: %s", err.Error())
+	}
+	// 轮换过程中文件暂时不可读或不匹配时继续使用旧证书
+	if err == nil && (r.cert == nil || !mod.Equal(r.certMod)) {
+		cert, loadErr := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if loadErr != nil && r.cert == nil {
+			return nil, fmt.Errorf("set Tls Cert Falied, ErrorInfo: %s", loadErr.Error())
+		}
+		if loadErr == nil {
+			r.cert, r.certMod = &cert, mod
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) rootCAs() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mod, err := modTime(r.caFile)
+	if err != nil && r.pool == nil {
+		return nil, fmt.Errorf("set caData Falied, ErrorInfo: %s", err.Error())
+	}
+	if err == nil && (r.pool == nil || !mod.Equal(r.caMod)) {
+		caData, readErr := ioutil.ReadFile(r.caFile)
+		pool := x509.NewCertPool()
+		if readErr == nil && !pool.AppendCertsFromPEM(caData) {
+			readErr = fmt.Errorf("no certificate found in %s", r.caFile)
+		}
+		if readErr != nil && r.pool == nil {
+			return nil, fmt.Errorf("set caData Falied, ErrorInfo: %s", readErr.Error())
+		}
+		if readErr == nil {
+			r.pool, r.caMod = pool, mod
+		}
+	}
+	return r.pool, nil
+}
+
+// 用最新的CA校验服务端证书链以及域名, 与内置校验的规则一致
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("etcd server presented no certificate")
+	}
+	pool, err := r.rootCAs()
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
+	return err
+}
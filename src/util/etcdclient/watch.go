@@ -0,0 +1,176 @@
+package etcdclient
+
+import (
+	"context"
+	"fmt"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"time"
+	"util/log"
+)
+
+// watch连接异常断开后重新建立的间隔
+const watchRetryInterval = time.Second
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+func (t EventType) String() string {
+	if t == EventDelete {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+// Watch回调的事件, DELETE事件中Kv只有Key和ModRevision
+// PrevKv为修改前的值, key是新建的或者之前的值未知时为nil
+type Event struct {
+	Type   EventType
+	Kv     KeyValue
+	PrevKv *KeyValue
+}
+
+// 回调返回错误时Watch停止并返回该错误
+type WatchHandler func(event Event) error
+
+// 监听前缀下的变化, 阻塞直到ctx结束或handler返回错误, ctx结束时返回nil
+// fromRevision为0时先全量读取, 对已有的key回调PUT事件, 再从读取时的revision之后开始监听
+// fromRevision大于0时从该revision开始监听, 用于进程重启后续接上次处理到的位置
+// 所需的历史版本已被压缩时重新全量读取, 与已知状态比对后补发PUT/DELETE事件
+// 以fromRevision启动时, 早于fromRevision的key在压缩后被删除不会补发DELETE事件
+func (e *EtcdClient) Watch(ctx context.Context, prefix string, fromRevision int64, handler WatchHandler) error {
+	if prefix == "" {
+		return fmt.Errorf("Watch Etcd Failed, Error Info: Empty Prefix")
+	}
+	w := &watcher{client: e, prefix: prefix, handler: handler, known: make(map[string]KeyValue)}
+
+	rev := fromRevision
+	if rev == 0 {
+		var err error
+		if rev, err = w.resync(ctx); err != nil {
+			return w.stopErr(ctx, err)
+		}
+	}
+
+	for {
+		next, compacted, err := w.watch(ctx, rev)
+		if err != nil {
+			return w.stopErr(ctx, err)
+		}
+		rev = next
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if compacted {
+			log.Warnf("监听前缀: %s 所需的revision: %d 已被压缩, 重新全量同步", prefix, rev)
+			if rev, err = w.resync(ctx); err != nil {
+				return w.stopErr(ctx, err)
+			}
+			continue
+		}
+
+		// 连接断开或没有leader, 等待后从上次处理到的revision继续
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+type watcher struct {
+	client  *EtcdClient
+	prefix  string
+	handler WatchHandler
+	// 已知的key及其当前值, 用于全量同步时比对出变化
+	known map[string]KeyValue
+}
+
+// ctx结束导致的错误视为正常停止
+func (w *watcher) stopErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// 从rev开始监听直到连接断开, 返回下一次监听的起始revision以及是否因历史版本被压缩而中断
+func (w *watcher) watch(ctx context.Context, rev int64) (int64, bool, error) {
+	// 要求集群有leader, 网络分区时尽快断开而不是一直挂起
+	wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	watchChan := w.client.Client.Watch(wctx, w.prefix, clientv3.WithPrefix(), clientv3.WithPrevKV(), clientv3.WithRev(rev))
+	for resp := range watchChan {
+		if resp.CompactRevision != 0 {
+			return rev, true, nil
+		}
+		if err := resp.Err(); err != nil {
+			log.Warnf("监听前缀: %s 中断, 错误信息: %s", w.prefix, err.Error())
+			return rev, false, nil
+		}
+		for _, ev := range resp.Events {
+			event := Event{Kv: toKeyValue(ev.Kv)}
+			if ev.PrevKv != nil {
+				prev := toKeyValue(ev.PrevKv)
+				event.PrevKv = &prev
+			}
+			if ev.Type == mvccpb.DELETE {
+				event.Type = EventDelete
+			}
+			if err := w.deliver(event); err != nil {
+				return rev, false, err
+			}
+			rev = ev.Kv.ModRevision + 1
+		}
+	}
+	return rev, false, nil
+}
+
+// 全量读取前缀并与已知状态比对, 补发变化的事件, 返回下一次监听的起始revision
+func (w *watcher) resync(ctx context.Context) (int64, error) {
+	kvs, rev, err := w.client.listWithRevision(ctx, w.prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	current := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		current[kv.Key] = true
+		event := Event{Type: EventPut, Kv: kv}
+		if prev, ok := w.known[kv.Key]; ok {
+			if prev.ModRevision == kv.ModRevision {
+				continue
+			}
+			event.PrevKv = &prev
+		}
+		if err := w.deliver(event); err != nil {
+			return 0, err
+		}
+	}
+	for key, prev := range w.known {
+		if current[key] {
+			continue
+		}
+		prev := prev
+		event := Event{Type: EventDelete, Kv: KeyValue{Key: key, ModRevision: rev}, PrevKv: &prev}
+		if err := w.deliver(event); err != nil {
+			return 0, err
+		}
+	}
+	return rev + 1, nil
+}
+
+func (w *watcher) deliver(event Event) error {
+	if event.Type == EventDelete {
+		delete(w.known, event.Kv.Key)
+	} else {
+		w.known[event.Kv.Key] = event.Kv
+	}
+	return w.handler(event)
+}
@@ -2,7 +2,7 @@ package log
 
 import (
 	"fmt"
-	"github.com/Sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"os"
 	"runtime"
 	"strings"